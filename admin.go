@@ -0,0 +1,381 @@
+package totp
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// adminUser is how users are shown by the admin API. Secrets & backup codes are never returned,
+// except for a newly generated secret (see adminSecret).
+type adminUser struct {
+	Username    string            `json:"username"`
+	Groups      []string          `json:"groups,omitempty"`
+	DisplayName string            `json:"display_name,omitempty"`
+	Email       string            `json:"email,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	Disabled    bool              `json:"disabled"`
+	Digits      int               `json:"digits,omitempty"`
+	Period      uint              `json:"period,omitempty"`
+	Algorithm   string            `json:"algorithm,omitempty"`
+	BackupCodes int               `json:"backup_codes"`
+}
+
+// adminCreateUser is the body of a request to create a user; their secret is generated for them.
+type adminCreateUser struct {
+	Username    string            `json:"username"`
+	Groups      []string          `json:"groups"`
+	DisplayName string            `json:"display_name"`
+	Email       string            `json:"email"`
+	Attributes  map[string]string `json:"attributes"`
+	Digits      int               `json:"digits"`
+	Period      uint              `json:"period"`
+	Algorithm   string            `json:"algorithm"`
+}
+
+// adminSecret is returned when a user's secret is (re)generated, for passing on to the user.
+type adminSecret struct {
+	User   *adminUser `json:"user"`
+	Secret string     `json:"secret"`
+
+	// QRCode is a base64 encoded PNG of the secret, for authenticator apps
+	QRCode string `json:"qr_code"`
+}
+
+// newAdminUser returns the admin API view of a user.
+func newAdminUser(u *User) *adminUser {
+	return &adminUser{
+		Username:    u.Username,
+		Groups:      u.Groups,
+		DisplayName: u.DisplayName,
+		Email:       u.Email,
+		Attributes:  u.Attributes,
+		Disabled:    u.Disabled,
+		Digits:      u.Digits,
+		Period:      u.Period,
+		Algorithm:   u.Algorithm,
+		BackupCodes: len(u.BackupCodes),
+	}
+}
+
+// adminEnabled returns if the admin API is served; it needs an admin token and/or group to be configured.
+func (s *server) adminEnabled() bool {
+	return s.adminURL != "" && (s.adminToken != "" || s.adminGroup != "")
+}
+
+// adminUsers is the handler for the admin API, under /admin/api/users
+//   - GET    /admin/api/users                  list users
+//   - POST   /admin/api/users                  create a user, returning their new secret
+//   - GET    /admin/api/users/{name}           get a user
+//   - DELETE /admin/api/users/{name}           delete a user (and revoke their sessions)
+//   - POST   /admin/api/users/{name}/secret    generate a new secret for a user
+//   - POST   /admin/api/users/{name}/disable   disable a user (and revoke their sessions)
+//   - POST   /admin/api/users/{name}/enable    re-enable a user
+//   - POST   /admin/api/users/{name}/revoke    revoke all of a user's current sessions
+func (s *server) adminUsers(w http.ResponseWriter, r *http.Request) {
+	admin, ok := s.authorizeAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	_, span := tracer.Start(r.Context(), "admin")
+	defer span.End()
+	span.SetAttributes(attribute.String("admin", admin), attribute.String("method", r.Method), attribute.String("path", r.URL.Path))
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, s.adminURL), "/")
+	username, action, _ := strings.Cut(rest, "/")
+
+	switch {
+	case username == "" && r.Method == http.MethodGet:
+		s.adminList(w)
+	case username == "" && r.Method == http.MethodPost:
+		s.adminCreate(w, r, admin)
+	case username == "":
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	case action == "" && r.Method == http.MethodGet:
+		s.adminGet(w, username)
+	case action == "" && r.Method == http.MethodDelete:
+		s.adminDelete(w, username, admin)
+	case action == "":
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	case r.Method != http.MethodPost:
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	case action == "secret":
+		s.adminResetSecret(w, username, admin)
+	case action == "disable":
+		s.adminSetDisabled(w, username, true, admin)
+	case action == "enable":
+		s.adminSetDisabled(w, username, false, admin)
+	case action == "revoke":
+		s.adminRevoke(w, username, admin)
+	default:
+		writeJSONError(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// authorizeAdmin checks the request is from an admin; either with the admin token as a bearer token,
+// or a session (cookie or bearer token) of a user in the admin group. Writes an error & returns false
+// if not, otherwise returns who the admin is (for logging).
+//
+// Browsers send session cookies with cross-site requests too, so requests that change anything
+// using a cookie must have a JSON body, which other sites can't send without our (CORS) permission.
+func (s *server) authorizeAdmin(w http.ResponseWriter, r *http.Request) (string, bool) {
+	bearer := bearerToken(r)
+	if s.adminToken != "" && bearer != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(s.adminToken)) == 1 {
+		return "admin-token", true
+	}
+
+	if s.adminGroup != "" {
+		if token := s.sessionToken(r); token != "" {
+			claims, err := s.validateSession(token)
+			if err != nil {
+				log.Println("Invalid JWT:", err)
+				writeJSONError(w, "Unauthorized", http.StatusUnauthorized)
+				return "", false
+			}
+			if !containsFold(claims.Groups, s.adminGroup) {
+				log.Println("Admin access denied:", claims.Username)
+				writeJSONError(w, "Forbidden", http.StatusForbidden)
+				return "", false
+			}
+			if token != bearer && r.Method != http.MethodGet && r.Method != http.MethodHead && !isJSONRequest(r) {
+				writeJSONError(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+				return "", false
+			}
+			return claims.Username, true
+		}
+	}
+
+	writeJSONError(w, "Unauthorized", http.StatusUnauthorized)
+	return "", false
+}
+
+// isJSONRequest returns if the request says its body is JSON.
+func isJSONRequest(r *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mt == "application/json"
+}
+
+// adminList writes all users.
+func (s *server) adminList(w http.ResponseWriter) {
+	users, err := s.store.(WritableStorage).Users()
+	if err != nil {
+		log.Println("Error listing users:", err)
+		writeJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	result := []*adminUser{}
+	for _, u := range users {
+		result = append(result, newAdminUser(u))
+	}
+	writeJSON(w, map[string]interface{}{"users": result}, http.StatusOK)
+}
+
+// adminGet writes a user.
+func (s *server) adminGet(w http.ResponseWriter, username string) {
+	u, ok := s.adminLoadUser(w, username)
+	if !ok {
+		return
+	}
+	writeJSON(w, newAdminUser(u), http.StatusOK)
+}
+
+// adminCreate creates a user with a new secret, writing the user & their secret.
+func (s *server) adminCreate(w http.ResponseWriter, r *http.Request, admin string) {
+	req := &adminCreateUser{}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(req)
+	if err != nil {
+		writeJSONError(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user := &User{
+		Username:    req.Username,
+		TOTPOptions: TOTPOptions{Digits: req.Digits, Period: req.Period, Algorithm: req.Algorithm},
+		Groups:      req.Groups,
+		DisplayName: req.DisplayName,
+		Email:       req.Email,
+		Attributes:  req.Attributes,
+	}
+	if user.Username == "" {
+		writeJSONError(w, "username is required", http.StatusBadRequest)
+		return
+	}
+	// users must be able to log in, and be addressable as /users/<username>
+	if !s.re.MatchString(user.Username) {
+		writeJSONError(w, "invalid username", http.StatusBadRequest)
+		return
+	}
+	qr, err := s.newAdminSecret(user)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = user.validate()
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.store.(WritableStorage).CreateUser(user)
+	if errors.Is(err, ErrUserExists) {
+		writeJSONError(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println("Error creating user:", err)
+		writeJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("User created:", user.Username, "by", admin)
+	writeJSON(w, &adminSecret{User: newAdminUser(user), Secret: user.Secret, QRCode: qr}, http.StatusCreated)
+}
+
+// adminResetSecret gives a user a new secret, writing the user & their secret.
+// Existing sessions aren't revoked (see adminRevoke).
+func (s *server) adminResetSecret(w http.ResponseWriter, username, admin string) {
+	user, ok := s.adminLoadUser(w, username)
+	if !ok {
+		return
+	}
+	qr, err := s.newAdminSecret(user)
+	if err != nil {
+		log.Println("Error generating TOTP:", err)
+		writeJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	// the old backup codes are for the old secret, eg. a lost device, so they go with it
+	user.BackupCodes = nil
+	if !s.adminUpdateUser(w, user) {
+		return
+	}
+
+	log.Println("User secret reset:", user.Username, "by", admin)
+	writeJSON(w, &adminSecret{User: newAdminUser(user), Secret: user.Secret, QRCode: qr}, http.StatusOK)
+}
+
+// adminSetDisabled disables (revoking their sessions) or enables a user, writing the user.
+func (s *server) adminSetDisabled(w http.ResponseWriter, username string, disabled bool, admin string) {
+	user, ok := s.adminLoadUser(w, username)
+	if !ok {
+		return
+	}
+	user.Disabled = disabled
+	if !s.adminUpdateUser(w, user) {
+		return
+	}
+	if disabled {
+		err := s.revocations.RevokeUser(user.Username, time.Now())
+		if err != nil {
+			log.Println("Error revoking sessions:", err)
+			writeJSONError(w, "User disabled, but their sessions couldn't be revoked", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	log.Println("User disabled:", user.Username, disabled, "by", admin)
+	writeJSON(w, newAdminUser(user), http.StatusOK)
+}
+
+// adminDelete deletes a user, and revokes their sessions.
+func (s *server) adminDelete(w http.ResponseWriter, username, admin string) {
+	err := s.store.(WritableStorage).DeleteUser(username)
+	if errors.Is(err, ErrUserNotFound) {
+		writeJSONError(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error deleting user:", err)
+		writeJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	err = s.revocations.RevokeUser(username, time.Now())
+	if err != nil {
+		log.Println("Error revoking sessions:", err)
+		writeJSONError(w, "User deleted, but their sessions couldn't be revoked", http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("User deleted:", username, "by", admin)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminRevoke revokes all of a user's current sessions.
+func (s *server) adminRevoke(w http.ResponseWriter, username, admin string) {
+	_, ok := s.adminLoadUser(w, username)
+	if !ok {
+		return
+	}
+	err := s.revocations.RevokeUser(username, time.Now())
+	if err != nil {
+		log.Println("Error revoking sessions:", err)
+		writeJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("User sessions revoked:", username, "by", admin)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// newAdminSecret sets a new secret (with the user's TOTP options) on the user, returning a base64 PNG QR code of it.
+func (s *server) newAdminSecret(user *User) (string, error) {
+	secret, _, qr, err := NewTOTPWithOptions(s.issuer, user.Username, user.TOTPOptions)
+	if err != nil {
+		return "", err
+	}
+	user.Secret = secret
+	return base64.StdEncoding.EncodeToString(qr), nil
+}
+
+// adminLoadUser loads a user, writing an error & returning false if we can't.
+func (s *server) adminLoadUser(w http.ResponseWriter, username string) (*User, bool) {
+	user, err := s.store.User(username)
+	if errors.Is(err, ErrUserNotFound) {
+		writeJSONError(w, err.Error(), http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		log.Println("Error loading user:", err)
+		writeJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return user, true
+}
+
+// adminUpdateUser saves a user, writing an error & returning false if we can't.
+func (s *server) adminUpdateUser(w http.ResponseWriter, user *User) bool {
+	err := s.store.(WritableStorage).UpdateUser(user)
+	if errors.Is(err, ErrUserNotFound) {
+		writeJSONError(w, err.Error(), http.StatusNotFound)
+		return false
+	} else if err != nil {
+		log.Println("Error updating user:", err)
+		writeJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// writeJSON writes v as a JSON response.
+func writeJSON(w http.ResponseWriter, v interface{}, code int) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Println("Error encoding JSON:", err)
+		writeError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+// writeJSONError writes an error as a JSON response, {"error": msg}.
+func writeJSONError(w http.ResponseWriter, msg string, code int) {
+	writeJSON(w, map[string]string{"error": msg}, code)
+}
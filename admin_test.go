@@ -0,0 +1,205 @@
+package totp
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+// adminRequest sends a request to the admin API with the admin token.
+func adminRequest(h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer admin-token")
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminAPI(t *testing.T) {
+	store, err := NewWritableFile(copyTestConfig(t))
+	assert.Nil(t, err)
+	s := newTestServer(t, WithStorage(store), WithAdminToken("admin-token"))
+	h := s.newHTTPHandler()
+
+	// list
+	w := adminRequest(h, http.MethodGet, "/admin/api/users", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	list := struct{ Users []*adminUser }{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Len(t, list.Users, 3)
+	assert.NotContains(t, w.Body.String(), "3UFC3DUK27KESHBWEJDQS4B2HXLHGFZV")
+
+	// create, with a generated secret
+	w = adminRequest(h, http.MethodPost, "/admin/api/users", `{"username": "alice", "groups": ["dev"], "digits": 8}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	created := &adminSecret{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), created))
+	assert.Equal(t, "alice", created.User.Username)
+	assert.Equal(t, []string{"dev"}, created.User.Groups)
+	assert.NotEmpty(t, created.Secret)
+	qr, err := base64.StdEncoding.DecodeString(created.QRCode)
+	assert.Nil(t, err)
+	assert.Equal(t, "\x89PNG", string(qr[:4]))
+
+	u, err := store.User("alice")
+	assert.Nil(t, err)
+	assert.Equal(t, created.Secret, u.Secret)
+	assert.Equal(t, 8, u.Digits)
+
+	w = adminRequest(h, http.MethodPost, "/admin/api/users", `{"username": "alice"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = adminRequest(h, http.MethodPost, "/admin/api/users", `{"username": "bob", "groups": ["a,b"]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = adminRequest(h, http.MethodPost, "/admin/api/users", `{"username": "bob/secret"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = adminRequest(h, http.MethodPost, "/admin/api/users", `{"username": "-bob"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = adminRequest(h, http.MethodPost, "/admin/api/users", `{"username": "bob smith"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = adminRequest(h, http.MethodPost, "/admin/api/users", `{`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// get
+	w = adminRequest(h, http.MethodGet, "/admin/api/users/alice", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"username":"alice"`)
+	assert.NotContains(t, w.Body.String(), created.Secret)
+	w = adminRequest(h, http.MethodGet, "/admin/api/users/nobody", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// reset secret, along with any backup codes
+	u, err = store.User("alice")
+	assert.Nil(t, err)
+	u.BackupCodes = []string{"sha256:01:aa"}
+	assert.Nil(t, store.UpdateUser(u))
+	w = adminRequest(h, http.MethodPost, "/admin/api/users/alice/secret", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	reset := &adminSecret{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), reset))
+	assert.NotEqual(t, created.Secret, reset.Secret)
+	u, err = store.User("alice")
+	assert.Nil(t, err)
+	assert.Equal(t, reset.Secret, u.Secret)
+	assert.Equal(t, 8, u.Digits)
+	assert.Empty(t, u.BackupCodes)
+
+	// disable revokes sessions
+	token := earlierSessionJWT(t, s.jwtKeys.Active(), "alice")
+	w = adminRequest(h, http.MethodPost, "/admin/api/users/alice/disable", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	u, err = store.User("alice")
+	assert.Nil(t, err)
+	assert.True(t, u.Disabled)
+	_, err = s.validateSession(token)
+	assert.NotNil(t, err)
+
+	w = adminRequest(h, http.MethodPost, "/admin/api/users/alice/enable", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	u, err = store.User("alice")
+	assert.Nil(t, err)
+	assert.False(t, u.Disabled)
+
+	// revoke
+	w = adminRequest(h, http.MethodPost, "/admin/api/users/alice/revoke", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = adminRequest(h, http.MethodPost, "/admin/api/users/nobody/revoke", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// delete
+	w = adminRequest(h, http.MethodDelete, "/admin/api/users/alice", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	_, err = store.User("alice")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	w = adminRequest(h, http.MethodDelete, "/admin/api/users/alice", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// unknown
+	w = adminRequest(h, http.MethodPost, "/admin/api/users/mary/promote", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = adminRequest(h, http.MethodPut, "/admin/api/users/mary", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestAdminAPICreatedUserCanLogin(t *testing.T) {
+	store, err := NewWritableFile(copyTestConfig(t))
+	assert.Nil(t, err)
+	s := newTestServer(t, WithStorage(store), WithAdminToken("admin-token"))
+
+	w := adminRequest(s.newHTTPHandler(), http.MethodPost, "/admin/api/users", `{"username": "alice"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	created := &adminSecret{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), created))
+
+	code, err := totp.GenerateCode(created.Secret, time.Now())
+	assert.Nil(t, err)
+	w = loginWithCSRF(t, s, "alice", code)
+	assert.Equal(t, http.StatusFound, w.Code)
+}
+
+func TestAdminAPIAuth(t *testing.T) {
+	store, err := NewWritableFile(copyTestConfig(t))
+	assert.Nil(t, err)
+	s := newTestServer(t, WithStorage(store), WithAdminToken("admin-token"), WithAdminGroup("admins"))
+	h := s.newHTTPHandler()
+
+	send := func(method, token, cookie, contentType string) int {
+		req := httptest.NewRequest(method, "/admin/api/users/mary/revoke", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: s.cookieName, Value: cookie})
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	admin, _, err := newSessionJWT(s.jwtKeys.Active(), &User{Username: "james", Groups: []string{"admins"}}, time.Hour)
+	assert.Nil(t, err)
+	user, _, err := newSessionJWT(s.jwtKeys.Active(), &User{Username: "test", Groups: []string{"dev"}}, time.Hour)
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodPost, "", "", ""))
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodPost, "wrong", "", ""))
+	assert.Equal(t, http.StatusNoContent, send(http.MethodPost, "admin-token", "", ""))
+
+	// sessions of users in the admin group, with a JSON request so other sites can't forge it
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodPost, "", "not-a-jwt", "application/json"))
+	assert.Equal(t, http.StatusForbidden, send(http.MethodPost, "", user, "application/json"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, send(http.MethodPost, "", admin, "application/x-www-form-urlencoded"))
+	assert.Equal(t, http.StatusNoContent, send(http.MethodPost, "", admin, "application/json"))
+
+	// or their bearer tokens, which other sites can't send
+	assert.Equal(t, http.StatusForbidden, send(http.MethodPost, user, "", ""))
+	assert.Equal(t, http.StatusNoContent, send(http.MethodPost, admin, "", ""))
+}
+
+func TestAdminAPIDisabled(t *testing.T) {
+	// not served without an admin token or group
+	store, err := NewWritableFile(copyTestConfig(t))
+	assert.Nil(t, err)
+	s := newTestServer(t, WithStorage(store))
+	w := adminRequest(s.newHTTPHandler(), http.MethodGet, "/admin/api/users", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// and requires writable storage
+	_, err = buildServer(
+		WithCSRFKey([]byte("test-csrf-key")),
+		WithJWTKey([]byte("test-jwt-key")),
+		WithStorage(NewDebugStorage()),
+		WithAdminToken("admin-token"),
+	)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,97 @@
+package totp
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	// backupCodeLength is the number of characters in a backup code (excluding the separator).
+	// Codes are base32, so this gives us 50 bits of randomness per code.
+	backupCodeLength = 10
+
+	// backupCodeSaltLength is the number of random bytes we salt each backup code hash with
+	backupCodeSaltLength = 16
+)
+
+// BackupCodeStorage is optionally implemented by WritableStorage backends that can use up a backup code
+// atomically, so servers sharing the storage can't both accept the same code.
+type BackupCodeStorage interface {
+	// UseBackupCode removes the user's backup code with the given hash, returning false if it's already gone
+	UseBackupCode(username, hash string) (bool, error)
+}
+
+// NewBackupCodes generates n one-time backup codes for a user.
+// Returns the codes to give to the user (formatted as xxxxx-xxxxx) and the hashes to store.
+func NewBackupCodes(n int) ([]string, []string, error) {
+	codes := make([]string, n)
+	hashes := make([]string, n)
+	for i := 0; i < n; i++ {
+		rng, err := randBytes(backupCodeLength) // more than enough bytes for our base32 chars
+		if err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(rng))[:backupCodeLength]
+		codes[i] = code[:backupCodeLength/2] + "-" + code[backupCodeLength/2:]
+
+		hashes[i], err = hashBackupCode(code)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return codes, hashes, nil
+}
+
+// normaliseBackupCode strips separators & case so codes can be typed however the user likes.
+func normaliseBackupCode(code string) string {
+	code = strings.ReplaceAll(code, "-", "")
+	code = strings.ReplaceAll(code, " ", "")
+	return strings.ToLower(code)
+}
+
+// hashBackupCode returns a salted hash of a backup code, as "sha256:<salt>:<hash>" (hex encoded).
+// A fast hash is fine here since codes are long & random (unlike passwords) and logins are rate limited.
+func hashBackupCode(code string) (string, error) {
+	salt, err := randBytes(backupCodeSaltLength)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x:%x", salt, backupCodeDigest(salt, code)), nil
+}
+
+// backupCodeDigest hashes a (normalised) backup code with the given salt
+func backupCodeDigest(salt []byte, code string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(normaliseBackupCode(code)))
+	return h.Sum(nil)
+}
+
+// matchBackupCode returns the index of the hash matching the given code, or -1 if there is no match.
+func matchBackupCode(hashes []string, code string) int {
+	if len(normaliseBackupCode(code)) != backupCodeLength {
+		return -1
+	}
+	for i, stored := range hashes {
+		parts := strings.Split(stored, ":")
+		if len(parts) != 3 || parts[0] != "sha256" {
+			continue
+		}
+		salt, err := hex.DecodeString(parts[1])
+		if err != nil {
+			continue
+		}
+		expect, err := hex.DecodeString(parts[2])
+		if err != nil {
+			continue
+		}
+		if subtle.ConstantTimeCompare(expect, backupCodeDigest(salt, code)) == 1 {
+			return i
+		}
+	}
+	return -1
+}
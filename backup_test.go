@@ -0,0 +1,27 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupCodes(t *testing.T) {
+	codes, hashes, err := NewBackupCodes(5)
+	assert.Nil(t, err)
+	assert.Len(t, codes, 5)
+	assert.Len(t, hashes, 5)
+
+	for i, code := range codes {
+		assert.Len(t, code, backupCodeLength+1)
+		assert.NotContains(t, hashes[i], normaliseBackupCode(code))
+
+		assert.Equal(t, i, matchBackupCode(hashes, code))
+		assert.Equal(t, i, matchBackupCode(hashes, strings.ToUpper(strings.ReplaceAll(code, "-", " "))))
+	}
+
+	assert.Equal(t, -1, matchBackupCode(hashes, "aaaaa-aaaaa"))
+	assert.Equal(t, -1, matchBackupCode(hashes, ""))
+	assert.Equal(t, -1, matchBackupCode([]string{"garbage", "sha256:zz:zz"}, codes[0]))
+}
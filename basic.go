@@ -0,0 +1,134 @@
+package totp
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BasicAuthMode is whether /auth/check accepts HTTP Basic auth, for clients like curl & git that can't log in.
+type BasicAuthMode string
+
+const (
+	// BasicAuthOff ignores Basic auth
+	BasicAuthOff BasicAuthMode = "off"
+
+	// BasicAuthCode accepts a username & TOTP code, as user:code
+	BasicAuthCode BasicAuthMode = "code"
+
+	// BasicAuthPassword accepts a username and the user's password followed by their TOTP code,
+	// as user:password123456. Users without a password (see User.PasswordHash) can't use Basic auth.
+	BasicAuthPassword BasicAuthMode = "password"
+)
+
+// validate checks the mode is one we know about
+func (m BasicAuthMode) validate() error {
+	switch m {
+	case BasicAuthOff, BasicAuthCode, BasicAuthPassword:
+		return nil
+	}
+	return fmt.Errorf("unknown basic auth mode %q", m)
+}
+
+// HashPassword returns a bcrypt hash of a password, for User.PasswordHash.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// checkPassword checks the secret is the user's password followed by a code, returning the code if so.
+// The code is however many digits the user's codes are.
+func checkPassword(user *User, secret string) (string, bool) {
+	digits := user.Digits
+	if digits == 0 {
+		digits = 6
+	}
+	if user.PasswordHash == "" || len(secret) <= digits {
+		return "", false
+	}
+	password, code := secret[:len(secret)-digits], secret[len(secret)-digits:]
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return "", false
+	}
+	return code, true
+}
+
+// basicAuthenticate checks Basic auth credentials as a login (see checkLogin), with the same rate limiting,
+// lockouts & replay protection. As clients send the same credentials with every request, and a code can only
+// be used once, credentials that were accepted are remembered for the basic auth TTL, like a short session.
+// Returns the session claims & http.StatusOK if the credentials are valid, otherwise http.StatusUnauthorized.
+func (s *server) basicAuthenticate(r *http.Request) (*JWTClaim, int) {
+	user, secret, _ := r.BasicAuth()
+
+	// we recheck revocations of remembered credentials as we would a JWT
+	key := s.basicSessionKey(r)
+	if claims, ok := s.basicSessions.Get(key); ok {
+		revoked, err := s.revocations.Revoked(claims)
+		if err != nil {
+			log.Println("Error checking revocation:", err)
+			return nil, http.StatusUnauthorized
+		} else if revoked {
+			log.Println("Basic auth session revoked:", claims.Username)
+			s.basicSessions.Remove(key)
+			return nil, http.StatusUnauthorized
+		}
+		return claims, http.StatusOK
+	}
+
+	if !s.allowLogin(r, user) {
+		return nil, http.StatusUnauthorized
+	}
+	u, reason, _ := s.checkLogin(r, user, secret, s.basicAuth == BasicAuthPassword)
+	if reason != "" {
+		log.Println("Basic auth failed:", user, reason)
+		return nil, http.StatusUnauthorized
+	}
+
+	_, span := tracer.Start(r.Context(), "login-success")
+	defer span.End()
+	span.AddEvent("Access approved")
+	span.SetAttributes(attribute.String("user", u.Username), attribute.String("login.method", "basic"))
+	log.Println("User logged in (Basic auth):", u.Username)
+
+	// an ID like a JWT's, so the session can be revoked by itself (see logoutPost)
+	id, err := randBytes(16)
+	if err != nil {
+		log.Println("Error generating session ID:", err)
+		return nil, http.StatusInternalServerError
+	}
+	now := time.Now()
+	claims := &JWTClaim{
+		Username:    u.Username,
+		Groups:      u.Groups,
+		DisplayName: u.DisplayName,
+		Email:       u.Email,
+		Attributes:  u.Attributes,
+	}
+	claims.Id = fmt.Sprintf("%x", id)
+	claims.IssuedAt = now.Unix()
+	claims.ExpiresAt = now.Add(s.basicAuthTTL).Unix()
+	s.basicSessions.Add(key, claims)
+	return claims, http.StatusOK
+}
+
+// basicSessionKey returns the key the request's Basic auth credentials are remembered by. We only keep a hash
+// of the credentials, along with the client IP so they're only remembered for the client that sent them;
+// elsewhere they're a new login (which fails, as the code has been used). Without a client IP header (see
+// WithClientIPHeader) clients behind a proxy all have the proxy's address, so this is only as good as that.
+func (s *server) basicSessionKey(r *http.Request) string {
+	user, secret, _ := r.BasicAuth()
+	ip := clientIP(r, s.clientIPHeader)
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(ip+"\n"+user+":"+secret)))
+}
+
+// isBasicAuth returns if the request has Basic auth credentials.
+func isBasicAuth(r *http.Request) bool {
+	scheme, _, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	return strings.EqualFold(scheme, "Basic")
+}
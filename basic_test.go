@@ -0,0 +1,157 @@
+package totp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+// basicCheck sends an /auth/check request with Basic auth credentials from the given client address.
+func basicCheck(h http.Handler, remoteAddr, user, password string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/auth/check", nil)
+	req.SetBasicAuth(user, password)
+	req.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := HashPassword("hunter2")
+	assert.Nil(t, err)
+	u := &User{Username: "mary", PasswordHash: hash}
+
+	code, ok := checkPassword(u, "hunter2123456")
+	assert.True(t, ok)
+	assert.Equal(t, "123456", code)
+
+	_, ok = checkPassword(u, "hunter3123456")
+	assert.False(t, ok)
+	_, ok = checkPassword(u, "123456")
+	assert.False(t, ok)
+
+	u.Digits = 8
+	code, ok = checkPassword(u, "hunter212345678")
+	assert.True(t, ok)
+	assert.Equal(t, "12345678", code)
+
+	_, ok = checkPassword(&User{Username: "james"}, "hunter2123456")
+	assert.False(t, ok)
+}
+
+func TestBasicAuthCode(t *testing.T) {
+	s := newTestServer(t, WithBasicAuth(BasicAuthCode, time.Minute))
+	h := s.newHTTPHandler()
+
+	// clients are told to send credentials
+	req := httptest.NewRequest(http.MethodGet, "/auth/check", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Basic realm="totp"`, w.Header().Get("WWW-Authenticate"))
+
+	w = basicCheck(h, "192.0.2.1:1234", "mary", "000000")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	code, err := totp.GenerateCode("3UFC3DUK27KESHBWEJDQS4B2HXLHGFZV", time.Now())
+	assert.Nil(t, err)
+	w = basicCheck(h, "192.0.2.1:1234", "mary", code)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "mary", w.Header().Get("X-Auth-User"))
+	assert.NotEmpty(t, w.Header().Get("X-Auth-Expires"))
+
+	// the same credentials keep working (without being rate limited) ..
+	for i := 0; i < 5; i++ {
+		w = basicCheck(h, "192.0.2.1:1234", "mary", code)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	// .. but the code can't be used to log in elsewhere
+	w = loginWithCSRF(t, s, "mary", code)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = basicCheck(h, "198.51.100.1:1234", "mary", code)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// until the user's sessions are revoked (including this second's)
+	assert.Nil(t, s.revocations.RevokeUser("mary", time.Now().Add(time.Second)))
+	w = basicCheck(h, "192.0.2.1:1234", "mary", code)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestBasicAuthLogout(t *testing.T) {
+	s := newTestServer(t, WithBasicAuth(BasicAuthCode, time.Minute), WithSecondsBetweenLogins(0))
+	h := s.newHTTPHandler()
+
+	mary, err := totp.GenerateCode("3UFC3DUK27KESHBWEJDQS4B2HXLHGFZV", time.Now())
+	assert.Nil(t, err)
+	james, err := totp.GenerateCode("CV4JDXSYVFRJTHMNG4HUKF3OSTOP6B3H", time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, basicCheck(h, "192.0.2.1:1234", "mary", mary).Code)
+	assert.Equal(t, http.StatusOK, basicCheck(h, "192.0.2.1:1234", "james", james).Code)
+
+	// logging out with the credentials revokes only that session
+	req := httptest.NewRequest(http.MethodPost, s.authLogoutURL, nil)
+	req.SetBasicAuth("mary", mary)
+	req.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusFound, w.Code)
+
+	assert.Equal(t, http.StatusUnauthorized, basicCheck(h, "192.0.2.1:1234", "mary", mary).Code)
+	assert.Equal(t, http.StatusOK, basicCheck(h, "192.0.2.1:1234", "james", james).Code)
+}
+
+func TestBasicAuthPassword(t *testing.T) {
+	store, err := NewWritableFile(copyTestConfig(t))
+	assert.Nil(t, err)
+	u, err := store.User("mary")
+	assert.Nil(t, err)
+	u.PasswordHash, err = HashPassword("hunter2")
+	assert.Nil(t, err)
+	assert.Nil(t, store.UpdateUser(u))
+
+	s := newTestServer(t, WithStorage(store), WithBasicAuth(BasicAuthPassword, time.Minute), WithSecondsBetweenLogins(0))
+	h := s.newHTTPHandler()
+
+	code, err := totp.GenerateCode("3UFC3DUK27KESHBWEJDQS4B2HXLHGFZV", time.Now())
+	assert.Nil(t, err)
+
+	// the code alone isn't enough
+	w := basicCheck(h, "192.0.2.1:1234", "mary", code)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = basicCheck(h, "192.0.2.1:1234", "mary", "wrong"+code)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = basicCheck(h, "192.0.2.2:1234", "mary", "hunter2"+code)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "mary", w.Header().Get("X-Auth-User"))
+
+	// users without a password can't use Basic auth
+	code, err = totp.GenerateCode("CV4JDXSYVFRJTHMNG4HUKF3OSTOP6B3H", time.Now())
+	assert.Nil(t, err)
+	w = basicCheck(h, "192.0.2.3:1234", "james", code)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestBasicAuthOff(t *testing.T) {
+	s := newTestServer(t)
+	h := s.newHTTPHandler()
+
+	code, err := totp.GenerateCode("3UFC3DUK27KESHBWEJDQS4B2HXLHGFZV", time.Now())
+	assert.Nil(t, err)
+	w := basicCheck(h, "192.0.2.1:1234", "mary", code)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Empty(t, w.Header().Get("WWW-Authenticate"))
+
+	_, err = buildServer(
+		WithCSRFKey([]byte("test-csrf-key")),
+		WithJWTKey([]byte("test-jwt-key")),
+		WithStorage(NewDebugStorage()),
+		WithBasicAuth("on", time.Minute),
+	)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,71 @@
+package totp
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TokenPrecedence is where we look for the session JWT of a request being authorized, and in which order.
+// The first place a token is found is used, even if the token turns out to be invalid.
+type TokenPrecedence string
+
+const (
+	// TokenCookieFirst uses the cookie, or if there isn't one an Authorization: Bearer header
+	TokenCookieFirst TokenPrecedence = "cookie"
+
+	// TokenBearerFirst uses an Authorization: Bearer header, or if there isn't one the cookie
+	TokenBearerFirst TokenPrecedence = "bearer"
+
+	// TokenCookieOnly ignores Authorization headers
+	TokenCookieOnly TokenPrecedence = "cookie-only"
+
+	// TokenBearerOnly ignores the cookie
+	TokenBearerOnly TokenPrecedence = "bearer-only"
+)
+
+// validate checks the precedence is one we know about
+func (p TokenPrecedence) validate() error {
+	switch p {
+	case TokenCookieFirst, TokenBearerFirst, TokenCookieOnly, TokenBearerOnly:
+		return nil
+	}
+	return fmt.Errorf("unknown token precedence %q", p)
+}
+
+// sessionToken returns the session JWT sent with the request, looking in the cookie and/or
+// Authorization header as configured. Returns "" if there is none.
+func (s *server) sessionToken(r *http.Request) string {
+	cookie := func() string {
+		c, err := r.Cookie(s.cookieName)
+		if err != nil {
+			return ""
+		}
+		return c.Value
+	}
+
+	switch s.tokenPrecedence {
+	case TokenCookieOnly:
+		return cookie()
+	case TokenBearerOnly:
+		return bearerToken(r)
+	case TokenBearerFirst:
+		if token := bearerToken(r); token != "" {
+			return token
+		}
+		return cookie()
+	}
+	if token := cookie(); token != "" {
+		return token
+	}
+	return bearerToken(r)
+}
+
+// bearerToken returns the token from an Authorization: Bearer header, or "" if there isn't one.
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
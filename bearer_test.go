@@ -0,0 +1,128 @@
+package totp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionToken(t *testing.T) {
+	request := func(cookie, auth string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/auth/check", nil)
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "totp-auth", Value: cookie})
+		}
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		return r
+	}
+
+	cases := []struct {
+		precedence TokenPrecedence
+		cookie     string
+		auth       string
+		expect     string
+	}{
+		{TokenCookieFirst, "c", "Bearer b", "c"},
+		{TokenCookieFirst, "", "Bearer b", "b"},
+		{TokenCookieFirst, "", "bearer  b ", "b"},
+		{TokenCookieFirst, "", "Basic b", ""},
+		{TokenBearerFirst, "c", "Bearer b", "b"},
+		{TokenBearerFirst, "c", "", "c"},
+		{TokenCookieOnly, "", "Bearer b", ""},
+		{TokenCookieOnly, "c", "Bearer b", "c"},
+		{TokenBearerOnly, "c", "", ""},
+		{TokenBearerOnly, "c", "Bearer b", "b"},
+	}
+	for _, c := range cases {
+		s := &server{cookieName: "totp-auth", tokenPrecedence: c.precedence}
+		assert.Equal(t, c.expect, s.sessionToken(request(c.cookie, c.auth)), "%s %q %q", c.precedence, c.cookie, c.auth)
+	}
+
+	assert.NotNil(t, TokenPrecedence("header").validate())
+	_, err := buildServer(
+		WithCSRFKey([]byte("test-csrf-key")),
+		WithJWTKey([]byte("test-jwt-key")),
+		WithStorage(NewDebugStorage()),
+		WithTokenPrecedence("header"),
+	)
+	assert.NotNil(t, err)
+}
+
+func TestAuthCheckBearer(t *testing.T) {
+	s := newTestServer(t)
+	h := s.newHTTPHandler()
+
+	token, err := newSignedJWT(s.jwtKeys.Active(), "mary", time.Hour)
+	assert.Nil(t, err)
+	check := func(cookie, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/auth/check", nil)
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: s.cookieName, Value: cookie})
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := check("", "Bearer "+token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "mary", w.Header().Get("X-Auth-User"))
+
+	assert.Equal(t, http.StatusUnauthorized, check("", "Bearer nope").Code)
+
+	// the cookie is preferred by default, even if it's invalid
+	assert.Equal(t, http.StatusUnauthorized, check("nope", "Bearer "+token).Code)
+
+	// revoked tokens aren't accepted
+	claims, err := s.validateSession(token)
+	assert.Nil(t, err)
+	assert.Nil(t, s.revocations.Revoke(claims.Id, time.Unix(claims.ExpiresAt, 0)))
+	assert.Equal(t, http.StatusUnauthorized, check("", "Bearer "+token).Code)
+}
+
+func TestLogoutBearer(t *testing.T) {
+	s := newTestServer(t)
+	h := s.newHTTPHandler()
+
+	token, err := newSignedJWT(s.jwtKeys.Active(), "mary", time.Hour)
+	assert.Nil(t, err)
+	request := func(method, url string) int {
+		req := httptest.NewRequest(method, url, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, s.authCheckURL))
+	assert.Equal(t, http.StatusFound, request(http.MethodPost, s.authLogoutURL))
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, s.authCheckURL))
+}
+
+func TestCheckRequestToHTTPBearer(t *testing.T) {
+	req := &authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{
+			Request: &authv3.AttributeContext_Request{
+				Http: &authv3.AttributeContext_HttpRequest{
+					Method:  http.MethodGet,
+					Host:    "app.example.com",
+					Path:    "/",
+					Headers: map[string]string{"authorization": "Bearer token", "x-auth-user": "someone"},
+				},
+			},
+		},
+	}
+	r := checkRequestToHTTP(context.Background(), req, "totp-auth")
+	assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+	assert.Empty(t, r.Header.Get("X-Auth-User"))
+}
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/alecthomas/kong"
@@ -13,26 +20,102 @@ import (
 )
 
 var cli struct {
-	Serve    cmdServe    `cmd help:"Serve the API"`
-	Generate cmdGenerate `cmd help:"Generate a TOTP QR code"`
+	Serve    cmdServe    `cmd:"" help:"Serve the API"`
+	Generate cmdGenerate `cmd:"" help:"Generate a TOTP QR code"`
+	Import   cmdImport   `cmd:"" help:"Import users from a YAML file into a storage backend"`
+	Secrets  cmdSecrets  `cmd:"" help:"Manage encryption of TOTP secrets at rest"`
+	Backup   cmdBackup   `cmd:"" name:"backup-codes" help:"Generate a new set of one-time backup codes for a user"`
+	Revoke   cmdRevoke   `cmd:"" help:"Revoke all current sessions of a user"`
+	Invite   cmdInvite   `cmd:"" help:"Create an invitation link for a user to enroll themselves"`
+	Password cmdPassword `cmd:"" help:"Set (or clear) a user's password, for HTTP Basic auth"`
+}
+
+// secretKeyFlags are the flags for the key used to encrypt TOTP secrets at rest
+type secretKeyFlags struct {
+	SecretKey     string `name:"secret-key" env:"SECRET_KEY" help:"Key used to encrypt TOTP secrets at rest"`
+	SecretKeyFile string `name:"secret-key-file" env:"SECRET_KEY_FILE" help:"File containing the key used to encrypt TOTP secrets at rest"`
+}
+
+// key returns the secret key, or nil if none was given
+func (f *secretKeyFlags) key() ([]byte, error) {
+	return readKey(f.SecretKey, f.SecretKeyFile)
+}
+
+// storageOptions returns the storage options for the given flags
+func (f *secretKeyFlags) storageOptions() ([]totp.StorageOption, error) {
+	key, err := f.key()
+	if err != nil || key == nil {
+		return nil, err
+	}
+	return []totp.StorageOption{totp.WithEncryptionKey(key)}, nil
+}
+
+// inviteKeyFlags are the flags for the key invitations are signed with
+type inviteKeyFlags struct {
+	InviteKey     string `name:"invite-key" env:"INVITE_KEY" help:"Key invitations are signed with (enables enrollment)"`
+	InviteKeyFile string `name:"invite-key-file" env:"INVITE_KEY_FILE" help:"File containing the key invitations are signed with"`
+}
+
+// key returns the invite key, or nil if none was given
+func (f *inviteKeyFlags) key() ([]byte, error) {
+	return readKey(f.InviteKey, f.InviteKeyFile)
 }
 
 type cmdServe struct {
-	Port     int    `long:"port" default:"8080" help:"Port to listen on" env:"PORT"`
-	Config   string `long:"config" default:"conf.yaml" help:"Config file path" env:"USER_CONFIG"`
-	Debug    bool   `long:"debug" help:"Enable debug mode." env:"DEBUG"`
-	JWTKey   string `long:"jwt-key" env:"JWT_KEY" help:"JWT signing key (required when not in debug mode)"`
-	CSRFKey  string `long:"csrf-key" env:"CSRF_KEY" help:"CSRF signing key (recommended)"`
-	Redirect string `long:"redirect" default:"/auth/check" env:"REDIRECT" help:"Redirect URL after login"`
-	LRUSize  int    `long:"lru-size" default:"250" env:"LRU_SIZE" help:"LRU cache size (used for remembering CSRF tokens)"`
-	LRUTTL   int    `long:"lru-ttl" default:"120" env:"LRU_TTL" help:"LRU cache TTL in seconds (used for remembering CSRF tokens)"` // 2 mins
-	JWTTTL   int    `long:"jwt-ttl" default:"7200" env:"JWT_TTL" help:"JWT session TTL in seconds"`                                 // 2 hours
-	LoginURL string `long:"auth-url" default:"/auth/login" env:"LOGIN_URL" help:"Auth URL"`
-	CheckURL string `long:"check-url" default:"/auth/check" env:"CHECK_URL" help:"Check URL"`
-	Cookie   string `long:"cookie" default:"totp-auth" env:"COOKIE" help:"Cookie name"`
+	Port            int      `long:"port" default:"8080" help:"Port to listen on" env:"PORT"`
+	GRPCPort        int      `name:"grpc-port" default:"0" env:"GRPC_PORT" help:"Port to serve the Envoy ext_authz gRPC service on (0 to disable)"`
+	Config          string   `long:"config" default:"conf.yaml" help:"Config file path" env:"USER_CONFIG"`
+	Storage         string   `name:"storage" env:"STORAGE" help:"Storage backend URL, eg. sqlite:///data/users.db or file://conf.yaml (overrides --config)"`
+	Reload          int      `name:"config-reload" default:"10" env:"CONFIG_RELOAD" help:"Seconds between checks for changes to the config file (0 to disable)"`
+	Debug           bool     `long:"debug" help:"Enable debug mode." env:"DEBUG"`
+	JWTKey          string   `long:"jwt-key" env:"JWT_KEY" help:"JWT signing key (required when not in debug mode)"`
+	JWTPEM          string   `name:"jwt-private-key-file" env:"JWT_PRIVATE_KEY_FILE" help:"PEM private key (RSA, EC or Ed25519) to sign JWTs with instead of --jwt-key"`
+	JWTKeyID        string   `name:"jwt-key-id" env:"JWT_KEY_ID" help:"Key ID (kid) for --jwt-private-key-file (defaults to the key thumbprint)"`
+	JWKSURL         string   `name:"jwks-url" default:"/.well-known/jwks.json" env:"JWKS_URL" help:"URL to serve public JWT keys on (empty to disable)"`
+	JWTDir          string   `name:"jwt-key-dir" env:"JWT_KEY_DIR" help:"Directory of JWT keys named <kid>.pem or <kid>.key, for key rotation"`
+	JWTKeys         string   `name:"jwt-keys" env:"JWT_KEYS" help:"Comma separated kid:secret JWT keys (HS256), for key rotation"`
+	JWTKID          string   `name:"jwt-active-key-id" env:"JWT_ACTIVE_KEY_ID" help:"ID of the key in --jwt-key-dir / --jwt-keys to sign with (defaults to the last by name)"`
+	CSRFKey         string   `long:"csrf-key" env:"CSRF_KEY" help:"CSRF signing key (recommended)"`
+	Redirect        string   `long:"redirect" default:"/auth/check" env:"REDIRECT" help:"Redirect URL after login"`
+	RedirectAllow   []string `name:"redirect-allow" env:"REDIRECT_ALLOW" help:"Hosts (eg. *.example.com) and/or path prefixes users may be sent back to after login (default any relative URL)"`
+	LRUSize         int      `long:"lru-size" default:"250" env:"LRU_SIZE" help:"LRU cache size (used for remembering CSRF tokens)"`
+	LRUTTL          int      `long:"lru-ttl" default:"120" env:"LRU_TTL" help:"LRU cache TTL in seconds (used for remembering CSRF tokens)"` // 2 mins
+	JWTTTL          int      `long:"jwt-ttl" default:"7200" env:"JWT_TTL" help:"JWT session TTL in seconds"`                                 // 2 hours
+	LoginURL        string   `name:"auth-url" aliases:"login-url" default:"/auth/login" env:"LOGIN_URL" help:"Auth URL (--login-url also works)"`
+	CheckURL        string   `long:"check-url" default:"/auth/check" env:"CHECK_URL" help:"Check URL"`
+	UserHeader      string   `name:"user-header" default:"X-Auth-User" env:"USER_HEADER" help:"Header /auth/check sets to the username (empty to disable)"`
+	GroupsHeader    string   `name:"groups-header" default:"X-Auth-Groups" env:"GROUPS_HEADER" help:"Header /auth/check sets to the user's groups (empty to disable)"`
+	ExpiresHeader   string   `name:"expires-header" default:"X-Auth-Expires" env:"EXPIRES_HEADER" help:"Header /auth/check sets to when the session expires (empty to disable)"`
+	Policy          string   `name:"policy" env:"POLICY" help:"YAML file of rules for which users may access which paths (default allows all users)"`
+	ForwardURL      string   `name:"forward-url" default:"/auth/forward" env:"FORWARD_URL" help:"Forward auth URL for Traefik / Caddy (empty to disable)"`
+	LoginRedirect   string   `name:"login-redirect-url" env:"LOGIN_REDIRECT_URL" help:"Login URL the forward auth URL redirects to, eg. https://auth.example.com/auth/login (defaults to --auth-url)"`
+	CookieDomain    string   `name:"cookie-domain" env:"COOKIE_DOMAIN" help:"Domain to set the cookie for, eg. example.com to share it with subdomains"`
+	TemplateDir     string   `name:"template-dir" env:"TEMPLATE_DIR" help:"Directory of templates (login.html, error.html) overriding the built in pages"`
+	APILoginURL     string   `name:"api-login-url" default:"/auth/api/login" env:"API_LOGIN_URL" help:"JSON login API URL, for non-browser clients (empty to disable)"`
+	EnrollURL       string   `name:"enroll-url" default:"/auth/enroll" env:"ENROLL_URL" help:"URL invited users enroll at"`
+	Issuer          string   `name:"issuer" default:"example.org" env:"ISSUER" help:"Issuer name shown in authenticator apps for enrolled users"`
+	AdminURL        string   `name:"admin-url" default:"/admin/api/users" env:"ADMIN_URL" help:"URL the admin API is served under"`
+	AdminToken      string   `name:"admin-token" env:"ADMIN_TOKEN" help:"Bearer token for the admin API (enables the admin API)"`
+	AdminGroup      string   `name:"admin-group" env:"ADMIN_GROUP" help:"Group whose users may use the admin API (enables the admin API)"`
+	LogoutURL       string   `name:"logout-url" default:"/auth/logout" env:"LOGOUT_URL" help:"Logout URL (empty to disable)"`
+	Cookie          string   `long:"cookie" default:"totp-auth" env:"COOKIE" help:"Cookie name"`
+	TokenPrecedence string   `name:"token-precedence" default:"cookie" enum:"cookie,bearer,cookie-only,bearer-only" env:"TOKEN_PRECEDENCE" help:"Where /auth/check reads sessions from; the cookie or an Authorization: Bearer header first, or only one of them"`
+	BasicAuth       string   `name:"basic-auth" default:"off" enum:"off,code,password" env:"BASIC_AUTH" help:"Accept HTTP Basic auth on /auth/check, as user:code or user:<password><code> (behind a proxy set --client-ip-header, or remembered credentials work from any client)"`
+	BasicAuthTTL    int      `name:"basic-auth-ttl" default:"900" env:"BASIC_AUTH_TTL" help:"Seconds accepted Basic auth credentials are remembered for"`
+
+	secretKeyFlags `embed:""`
+	inviteKeyFlags `embed:""`
 
 	OtelResourceAttributes string `long:"otel-resource-attributes" env:"OTEL_RESOURCE_ATTRIBUTES" help:"OpenTelemetry resource attributes" default:"service.name=totp,service.version=0.0.0"`
 	SecondsBetweenLogins   int64  `long:"seconds-between-logins" default:"1" env:"SECONDS_BETWEEN_LOGINS" help:"Minimum time between logins in seconds"`
+	LoginBurst             int    `name:"login-burst" default:"3" env:"LOGIN_BURST" help:"Login attempts allowed at once before rate limiting"`
+	RateLimitKey           string `name:"rate-limit-key" default:"ip" enum:"ip,user,both" env:"RATE_LIMIT_KEY" help:"Rate limit logins by client IP, username or both"`
+
+	ClientIPHeader   string `name:"client-ip-header" env:"CLIENT_IP_HEADER" help:"Header to read the client IP from when behind a proxy (eg. X-Real-IP), client IPs are only locked out when set"`
+	LockoutThreshold int    `name:"lockout-threshold" default:"5" env:"LOCKOUT_THRESHOLD" help:"Failed logins before a user or client IP is locked out (0 to disable)"`
+	LockoutDelay     int    `name:"lockout-delay" default:"30" env:"LOCKOUT_DELAY" help:"Seconds the first lockout lasts, doubling for each further failure"`
+	LockoutMaxDelay  int    `name:"lockout-max-delay" default:"900" env:"LOCKOUT_MAX_DELAY" help:"Maximum lockout in seconds"`
+	LockoutReset     int    `name:"lockout-reset" default:"3600" env:"LOCKOUT_RESET" help:"Seconds without a failed login before failures are forgotten"`
 
 	HTTPReadTimeout  int `long:"http-read-timeout" default:"1" env:"HTTP_READ_TIMEOUT" help:"HTTP read timeout in seconds"`
 	HTTPWriteTimeout int `long:"http-write-timeout" default:"1" env:"HTTP_WRITE_TIMEOUT" help:"HTTP write timeout in seconds"`
@@ -40,7 +123,7 @@ type cmdServe struct {
 
 // defaults sets up some default values for the server, generating keys if needed (debug mode only)
 func (c *cmdServe) defaults() error {
-	if c.JWTKey == "" {
+	if c.JWTKey == "" && c.JWTPEM == "" && c.JWTDir == "" && c.JWTKeys == "" {
 		if c.Debug {
 			if c.JWTKey == "" {
 				log.Println("No JWT key provided, generating a random one")
@@ -81,48 +164,461 @@ func (c *cmdServe) Run() error {
 		log.Println("Debug mode enabled, loading test user only")
 		store = totp.NewDebugStorage()
 	} else {
-		store, err = totp.NewReadonlyFile(c.Config)
+		opts, err := c.storageOptions()
 		if err != nil {
 			return err
 		}
+		store, err = openStorage(c.Config, c.Storage, opts...)
+		if err != nil {
+			return err
+		}
+	}
+
+	// pick up changes to YAML user files without a restart
+	if w, ok := store.(interface {
+		Watch(context.Context, time.Duration)
+	}); ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go w.Watch(ctx, time.Duration(c.Reload)*time.Second)
+	}
+
+	jwtOpt, err := c.jwtOption()
+	if err != nil {
+		return err
 	}
-	return totp.ServeHTTP(
-		totp.WithCSRFKey([]byte(c.JWTKey)),
-		totp.WithJWTKey([]byte(c.CSRFKey)),
+
+	opts := []totp.WebOption{
+		totp.WithCSRFKey([]byte(c.CSRFKey)),
+		jwtOpt,
+		totp.WithJWKSURL(c.JWKSURL),
 		totp.WithPort(c.Port),
+		totp.WithGRPCPort(c.GRPCPort),
 		totp.WithStorage(store),
 		totp.WithLRUCacheSize(c.LRUSize),
-		totp.WithLRUCacheTTL(time.Duration(c.LRUTTL)*time.Second),
-		totp.WithJWTSessionTTL(time.Duration(c.JWTTTL)*time.Second),
+		totp.WithLRUCacheTTL(time.Duration(c.LRUTTL) * time.Second),
+		totp.WithJWTSessionTTL(time.Duration(c.JWTTTL) * time.Second),
 		totp.WithRedirect(c.Redirect),
+		totp.WithRedirectAllowList(c.RedirectAllow...),
 		totp.WithAuthCheckURL(c.CheckURL),
 		totp.WithAuthLoginURL(c.LoginURL),
+		totp.WithAuthLogoutURL(c.LogoutURL),
+		totp.WithAuthForwardURL(c.ForwardURL),
+		totp.WithLoginRedirectURL(c.LoginRedirect),
+		totp.WithCookieDomain(c.CookieDomain),
 		totp.WithCookieName(c.Cookie),
+		totp.WithTokenPrecedence(totp.TokenPrecedence(c.TokenPrecedence)),
+		totp.WithBasicAuth(totp.BasicAuthMode(c.BasicAuth), time.Duration(c.BasicAuthTTL)*time.Second),
+		totp.WithTemplateDir(c.TemplateDir),
+		totp.WithAuthAPILoginURL(c.APILoginURL),
+		totp.WithAuthEnrollURL(c.EnrollURL),
+		totp.WithIssuer(c.Issuer),
+		totp.WithAdminURL(c.AdminURL),
+		totp.WithAdminToken(c.AdminToken),
+		totp.WithAdminGroup(c.AdminGroup),
+		totp.WithIdentityHeaders(c.UserHeader, c.GroupsHeader, c.ExpiresHeader),
 		totp.WithSecondsBetweenLogins(c.SecondsBetweenLogins),
-		totp.WithHTTPReadTimeout(time.Duration(c.HTTPReadTimeout)*time.Second),
-		totp.WithHTTPWriteTimeout(time.Duration(c.HTTPWriteTimeout)*time.Second),
-	)
+		totp.WithLoginBurst(c.LoginBurst),
+		totp.WithRateLimitKey(totp.RateLimitKey(c.RateLimitKey)),
+		totp.WithHTTPReadTimeout(time.Duration(c.HTTPReadTimeout) * time.Second),
+		totp.WithHTTPWriteTimeout(time.Duration(c.HTTPWriteTimeout) * time.Second),
+		totp.WithClientIPHeader(c.ClientIPHeader),
+		totp.WithLockoutThreshold(c.LockoutThreshold),
+		totp.WithLockoutDelay(time.Duration(c.LockoutDelay)*time.Second, time.Duration(c.LockoutMaxDelay)*time.Second),
+		totp.WithLockoutReset(time.Duration(c.LockoutReset) * time.Second),
+	}
+
+	if c.Policy != "" {
+		policy, err := totp.LoadPolicyFile(c.Policy)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, totp.WithPolicy(policy))
+	}
+
+	inviteKey, err := c.inviteKeyFlags.key()
+	if err != nil {
+		return err
+	}
+	if inviteKey != nil {
+		opts = append(opts, totp.WithInviteKey(inviteKey))
+	}
+
+	// if our storage can remember used TOTP codes (eg. SQLite) then use it, so replicas
+	// sharing the storage also share replay protection
+	if rs, ok := store.(totp.ReplayStore); ok {
+		opts = append(opts, totp.WithReplayStore(rs))
+	}
+	if rs, ok := store.(totp.RevocationStore); ok {
+		opts = append(opts, totp.WithRevocationStore(rs))
+	}
+
+	return totp.ServeHTTP(opts...)
+}
+
+// jwtOption returns the option setting the key(s) we sign JWTs with; a keyring, a private key or a shared secret.
+func (c *cmdServe) jwtOption() (totp.WebOption, error) {
+	if c.JWTDir != "" || c.JWTKeys != "" {
+		var ring *totp.JWTKeyring
+		var err error
+		if c.JWTDir != "" && c.JWTKeys != "" {
+			return nil, fmt.Errorf("only one of --jwt-key-dir or --jwt-keys may be given")
+		} else if c.JWTDir != "" {
+			ring, err = totp.LoadJWTKeyringDir(c.JWTDir, c.JWTKID)
+		} else {
+			ring, err = totp.LoadJWTKeyringEnv(c.JWTKeys, c.JWTKID)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load JWT keys: %w", err)
+		}
+
+		// keep accepting tokens signed with a (legacy) single key, so moving to a keyring doesn't log everyone out
+		if c.JWTKey != "" {
+			verify := append([]*totp.JWTKey{totp.NewHMACJWTKey("", []byte(c.JWTKey))}, ring.Keys()[1:]...)
+			ring, err = totp.NewJWTKeyring(ring.Active(), verify...)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		log.Println("Signing JWTs with", ring.Active().Algorithm(), "key", ring.Active().ID, "of", len(ring.Keys()))
+		return totp.WithJWTKeyring(ring), nil
+	}
+
+	if c.JWTPEM != "" {
+		data, err := os.ReadFile(c.JWTPEM)
+		if err != nil {
+			return nil, err
+		}
+		key, err := totp.ParsePEMJWTKey(c.JWTKeyID, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse JWT private key: %w", err)
+		}
+		log.Println("Signing JWTs with", key.Algorithm(), "key", key.ID)
+		return totp.WithJWTSigningKey(key), nil
+	}
+
+	return totp.WithJWTKey([]byte(c.JWTKey)), nil
 }
 
 type cmdGenerate struct {
-	Issuer  string `short:"i" long:"issuer" default:"example.org" env:"ISSUER" help:"Issuer name for TOTP"`
-	Account string `arg:"" help:"Account name"`
-	Output  string `long:"output" short:"o" default:"qr.png" help:"Path to save QR code"`
+	Issuer    string `short:"i" long:"issuer" default:"example.org" env:"ISSUER" help:"Issuer name for TOTP"`
+	Account   string `arg:"" help:"Account name"`
+	Output    string `long:"output" short:"o" default:"qr.png" help:"Path to save QR code"`
+	Digits    int    `name:"digits" default:"6" help:"Number of digits in each code (6 or 8)"`
+	Period    uint   `name:"period" default:"30" help:"Seconds each code is valid for"`
+	Algorithm string `name:"algorithm" default:"SHA1" enum:"SHA1,SHA256,SHA512,MD5" help:"TOTP hash algorithm"`
+	Skew      int    `name:"skew" default:"0" help:"Periods either side of now to accept codes for (0 for the default of 1, -1 for none)"`
 }
 
 // Run generates a new TOTP secret and saves a QR code to the output path.
 // Intended for an admin creating a user account
 func (c *cmdGenerate) Run() error {
-	secret, _, qrData, err := totp.NewTOTP(c.Issuer, c.Account)
+	opts := totp.TOTPOptions{Digits: c.Digits, Period: c.Period, Algorithm: c.Algorithm}
+	secret, _, qrData, err := totp.NewTOTPWithOptions(c.Issuer, c.Account, opts)
 	if err != nil {
 		return err
 	}
 
 	fmt.Println("Secret:", secret)
+	if c.Digits != 6 || c.Period != 30 || c.Algorithm != "SHA1" {
+		// non defaults need to be set on the user too
+		fmt.Println("Digits:", c.Digits)
+		fmt.Println("Period:", c.Period)
+		fmt.Println("Algorithm:", c.Algorithm)
+	}
+	if c.Skew != 0 {
+		// only used by the server, so not in the QR code
+		fmt.Println("Skew:", c.Skew)
+	}
 	fmt.Println("QR code saved to:", c.Output)
 	return os.WriteFile(c.Output, qrData, 0644)
 }
 
+type cmdBackup struct {
+	Config  string `name:"config" default:"conf.yaml" help:"Config file path" env:"USER_CONFIG"`
+	Storage string `name:"storage" env:"STORAGE" help:"Storage backend URL, eg. sqlite:///data/users.db or file://conf.yaml (overrides --config)"`
+	Count   int    `short:"n" name:"count" default:"10" help:"Number of backup codes to generate"`
+	Account string `arg:"" help:"Account name"`
+
+	secretKeyFlags `embed:""`
+}
+
+// Run generates backup codes for a user, replacing any they already have.
+// The codes are printed once; only their hashes are stored.
+func (c *cmdBackup) Run() error {
+	opts, err := c.storageOptions()
+	if err != nil {
+		return err
+	}
+	store, err := openWritableStorage(c.Config, c.Storage, opts...)
+	if err != nil {
+		return err
+	}
+	user, err := store.User(c.Account)
+	if err != nil {
+		return err
+	}
+
+	codes, hashes, err := totp.NewBackupCodes(c.Count)
+	if err != nil {
+		return err
+	}
+	user.BackupCodes = hashes
+	err = store.UpdateUser(user)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Backup codes for", c.Account, "(each can be used once):")
+	for _, code := range codes {
+		fmt.Println(" ", code)
+	}
+	return nil
+}
+
+type cmdInvite struct {
+	URL     string   `name:"url" required:"" env:"INVITE_URL" help:"Full URL of the server's enroll page, eg. https://auth.example.com/auth/enroll"`
+	TTL     int      `name:"ttl" default:"259200" help:"Seconds the invitation is valid for"`
+	Groups  []string `name:"group" help:"Group to add the user to (may be repeated)"`
+	Name    string   `name:"name" help:"User's display name"`
+	Email   string   `name:"email" help:"User's email address"`
+	Account string   `arg:"" help:"Account name"`
+
+	inviteKeyFlags `embed:""`
+}
+
+// Run prints a signed invitation link, which the user opens to set up their own TOTP secret.
+// The server must be given the same invite key.
+func (c *cmdInvite) Run() error {
+	key, err := c.inviteKeyFlags.key()
+	if err != nil {
+		return err
+	}
+	user := &totp.User{Username: c.Account, Groups: c.Groups, DisplayName: c.Name, Email: c.Email}
+	token, err := totp.NewInvitation(key, user, time.Duration(c.TTL)*time.Second)
+	if err != nil {
+		return err
+	}
+
+	sep := "?"
+	if strings.Contains(c.URL, "?") {
+		sep = "&"
+	}
+	fmt.Println(c.URL + sep + "invite=" + url.QueryEscape(token))
+	return nil
+}
+
+type cmdRevoke struct {
+	Storage string `name:"storage" required:"" env:"STORAGE" help:"Storage backend URL shared with the server, eg. sqlite:///data/users.db"`
+	Account string `arg:"" help:"Account name"`
+}
+
+// Run revokes every session of the user issued before now, forcing them to log in again.
+// Only works with storage that the server also uses to check revocations (eg. SQLite).
+func (c *cmdRevoke) Run() error {
+	store, err := totp.OpenStorage(c.Storage)
+	if err != nil {
+		return err
+	}
+	rs, ok := store.(totp.RevocationStore)
+	if !ok {
+		return fmt.Errorf("storage %s can't record revoked sessions", c.Storage)
+	}
+	err = rs.RevokeUser(c.Account, time.Now())
+	if err == nil {
+		fmt.Println("Revoked sessions for:", c.Account)
+	}
+	return err
+}
+
+type cmdPassword struct {
+	Config  string `name:"config" default:"conf.yaml" help:"Config file path" env:"USER_CONFIG"`
+	Storage string `name:"storage" env:"STORAGE" help:"Storage backend URL, eg. sqlite:///data/users.db or file://conf.yaml (overrides --config)"`
+	Clear   bool   `name:"clear" help:"Remove the user's password"`
+	Account string `arg:"" help:"Account name"`
+
+	secretKeyFlags `embed:""`
+}
+
+// Run reads a password from stdin (the first line) and stores a hash of it for the user.
+func (c *cmdPassword) Run() error {
+	opts, err := c.storageOptions()
+	if err != nil {
+		return err
+	}
+	store, err := openWritableStorage(c.Config, c.Storage, opts...)
+	if err != nil {
+		return err
+	}
+	user, err := store.User(c.Account)
+	if err != nil {
+		return err
+	}
+
+	user.PasswordHash = ""
+	if !c.Clear {
+		fmt.Fprintln(os.Stderr, "Password for", c.Account+":")
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		password = strings.TrimRight(password, "\r\n")
+		if password == "" {
+			return fmt.Errorf("a password is required")
+		}
+		user.PasswordHash, err = totp.HashPassword(password)
+		if err != nil {
+			return err
+		}
+	}
+	err = store.UpdateUser(user)
+	if err == nil {
+		fmt.Println("Password updated for:", c.Account)
+	}
+	return err
+}
+
+type cmdImport struct {
+	Storage string `name:"storage" required:"" env:"STORAGE" help:"Storage backend URL to import into, eg. sqlite:///data/users.db"`
+	File    string `arg:"" help:"YAML user file to import"`
+
+	secretKeyFlags `embed:""`
+}
+
+// Run copies all users from a YAML file into a (writable) storage backend.
+// Users that already exist in the target are updated.
+func (c *cmdImport) Run() error {
+	opts, err := c.storageOptions()
+	if err != nil {
+		return err
+	}
+	src, err := totp.NewWritableFile(c.File, opts...)
+	if err != nil {
+		return err
+	}
+	dst, err := openWritableStorage("", c.Storage, opts...)
+	if err != nil {
+		return err
+	}
+
+	users, err := src.Users()
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		err = dst.CreateUser(u)
+		if errors.Is(err, totp.ErrUserExists) {
+			err = dst.UpdateUser(u)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to import %s: %w", u.Username, err)
+		}
+		fmt.Println("Imported:", u.Username)
+	}
+	return nil
+}
+
+// openStorage opens the storage backend given by URL, falling back to a read only
+// YAML config file if no URL is given.
+func openStorage(config, url string, opts ...totp.StorageOption) (totp.Storage, error) {
+	if url == "" {
+		return totp.NewReadonlyFile(config, opts...)
+	}
+	return totp.OpenStorage(url, opts...)
+}
+
+// openWritableStorage is openStorage for commands that need to modify users.
+func openWritableStorage(config, url string, opts ...totp.StorageOption) (totp.WritableStorage, error) {
+	if url == "" {
+		url = "file://" + config
+	}
+	store, err := totp.OpenStorage(url, opts...)
+	if err != nil {
+		return nil, err
+	}
+	ws, ok := store.(totp.WritableStorage)
+	if !ok {
+		return nil, fmt.Errorf("storage %s is not writable", url)
+	}
+	return ws, nil
+}
+
+type cmdSecrets struct {
+	Encrypt cmdSecretsEncrypt `cmd:"" help:"Encrypt the TOTP secrets in a YAML user file"`
+	Rotate  cmdSecretsRotate  `cmd:"" help:"Re-encrypt the TOTP secrets in a YAML user file with a new key"`
+}
+
+type cmdSecretsEncrypt struct {
+	File string `arg:"" help:"YAML user file to encrypt (in place)"`
+
+	secretKeyFlags `embed:""`
+}
+
+// Run encrypts any plain secrets in the file. Already encrypted secrets are re-encrypted
+// (so they must have been encrypted with the same key).
+func (c *cmdSecretsEncrypt) Run() error {
+	key, err := c.key()
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return fmt.Errorf("a secret key is required")
+	}
+	err = totp.RekeyFile(c.File, key, key)
+	if err == nil {
+		fmt.Println("Encrypted secrets in:", c.File)
+	}
+	return err
+}
+
+type cmdSecretsRotate struct {
+	File       string `arg:"" help:"YAML user file to re-encrypt (in place)"`
+	OldKey     string `name:"old-key" env:"OLD_SECRET_KEY" help:"Key the secrets are currently encrypted with"`
+	OldKeyFile string `name:"old-key-file" env:"OLD_SECRET_KEY_FILE" help:"File containing the key the secrets are currently encrypted with"`
+	NewKey     string `name:"new-key" env:"NEW_SECRET_KEY" help:"Key to encrypt the secrets with"`
+	NewKeyFile string `name:"new-key-file" env:"NEW_SECRET_KEY_FILE" help:"File containing the key to encrypt the secrets with"`
+}
+
+// Run decrypts the secrets in the file with the old key and encrypts them with the new one.
+func (c *cmdSecretsRotate) Run() error {
+	oldKey, err := readKey(c.OldKey, c.OldKeyFile)
+	if err != nil {
+		return err
+	}
+	newKey, err := readKey(c.NewKey, c.NewKeyFile)
+	if err != nil {
+		return err
+	}
+	if oldKey == nil || newKey == nil {
+		return fmt.Errorf("both an old and new key are required")
+	}
+	err = totp.RekeyFile(c.File, oldKey, newKey)
+	if err == nil {
+		fmt.Println("Rotated secrets in:", c.File)
+	}
+	return err
+}
+
+// readKey returns a key given either directly or as a file path (trailing whitespace
+// is trimmed from files). Returns nil if neither is set.
+func readKey(value, filename string) ([]byte, error) {
+	if value != "" && filename != "" {
+		return nil, fmt.Errorf("only one of a key or key file may be given")
+	}
+	if value != "" {
+		return []byte(value), nil
+	}
+	if filename == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(data, " \r\n\t"), nil
+}
+
 // randBytes generates n random bytes.
 // Only used to be helpful & generate keys for debug style mode.
 func randBytes(n int) ([]byte, error) {
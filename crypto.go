@@ -0,0 +1,94 @@
+package totp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// encryptedSecretPrefix marks a TOTP secret as encrypted (and with what scheme).
+// v1 is AES-256-GCM, with the nonce prepended to the ciphertext & the username as additional data.
+const encryptedSecretPrefix = "enc:v1:"
+
+// secretCipher encrypts & decrypts TOTP secrets at rest.
+type secretCipher struct {
+	aead cipher.AEAD
+}
+
+// newSecretCipher creates a new secretCipher from the given key material.
+// The key is hashed with SHA-256 to give us an AES-256 key, so it should be a long random
+// value (like our JWT & CSRF keys) rather than a human chosen password.
+func newSecretCipher(key []byte) (*secretCipher, error) {
+	if len(key) == 0 {
+		return nil, fmt.Errorf("encryption key is empty")
+	}
+	k := sha256.Sum256(key)
+	block, err := aes.NewCipher(k[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &secretCipher{aead: aead}, nil
+}
+
+// isEncryptedSecret returns if the given secret value is encrypted.
+func isEncryptedSecret(value string) bool {
+	return strings.HasPrefix(value, encryptedSecretPrefix)
+}
+
+// encrypt encrypts a user's secret, binding it to their username so secrets can't be swapped between users.
+func (c *secretCipher) encrypt(username, secret string) (string, error) {
+	nonce, err := randBytes(c.aead.NonceSize())
+	if err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, []byte(secret), []byte(username))
+	return encryptedSecretPrefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt decrypts a user's secret. Values that aren't encrypted are returned as-is, so
+// files can be migrated gradually.
+func (c *secretCipher) decrypt(username, value string) (string, error) {
+	if !isEncryptedSecret(value) {
+		return value, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(value, encryptedSecretPrefix))
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted secret for %s: %w", username, err)
+	}
+	if len(data) < c.aead.NonceSize() {
+		return "", fmt.Errorf("invalid encrypted secret for %s: too short", username)
+	}
+	nonce, ciphertext := data[:c.aead.NonceSize()], data[c.aead.NonceSize():]
+	plain, err := c.aead.Open(nil, nonce, ciphertext, []byte(username))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret for %s (wrong key?)", username)
+	}
+	return string(plain), nil
+}
+
+// decryptSecret decrypts a secret with an optional cipher, erroring if the secret is
+// encrypted but we have no key.
+func decryptSecret(c *secretCipher, username, value string) (string, error) {
+	if c != nil {
+		return c.decrypt(username, value)
+	}
+	if isEncryptedSecret(value) {
+		return "", fmt.Errorf("secret for %s is encrypted but no encryption key was given", username)
+	}
+	return value, nil
+}
+
+// encryptSecret encrypts a secret if we have a cipher, otherwise returns it as-is.
+func encryptSecret(c *secretCipher, username, value string) (string, error) {
+	if c == nil {
+		return value, nil
+	}
+	return c.encrypt(username, value)
+}
@@ -0,0 +1,72 @@
+package totp
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretCipher(t *testing.T) {
+	c, err := newSecretCipher([]byte("test-key"))
+	assert.Nil(t, err)
+	other, err := newSecretCipher([]byte("other-key"))
+	assert.Nil(t, err)
+
+	enc, err := c.encrypt("mary", "3UFC3DUK27KESHBWEJDQS4B2HXLHGFZV")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(enc, encryptedSecretPrefix))
+
+	cases := []struct {
+		Name        string
+		Cipher      *secretCipher
+		Username    string
+		Value       string
+		Expect      string
+		ExpectError bool
+	}{
+		{"decrypts", c, "mary", enc, "3UFC3DUK27KESHBWEJDQS4B2HXLHGFZV", false},
+		{"plain-passthrough", c, "mary", "JBSWY3DPEHPK3PXP", "JBSWY3DPEHPK3PXP", false},
+		{"wrong-key", other, "mary", enc, "", true},
+		{"wrong-user", c, "james", enc, "", true},
+		{"no-key", nil, "mary", enc, "", true},
+		{"garbage", c, "mary", encryptedSecretPrefix + "!!!", "", true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			result, err := decryptSecret(tc.Cipher, tc.Username, tc.Value)
+			if tc.ExpectError {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, tc.Expect, result)
+			}
+		})
+	}
+}
+
+func TestRekeyFile(t *testing.T) {
+	filename := copyTestConfig(t)
+
+	// encrypt a plain file
+	assert.Nil(t, RekeyFile(filename, nil, []byte("key-1")))
+	data, err := os.ReadFile(filename)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), "3UFC3DUK27KESHBWEJDQS4B2HXLHGFZV")
+
+	_, err = NewReadonlyFile(filename)
+	assert.NotNil(t, err)
+
+	// rotate to a new key
+	assert.Nil(t, RekeyFile(filename, []byte("key-1"), []byte("key-2")))
+	_, err = NewReadonlyFile(filename, WithEncryptionKey([]byte("key-1")))
+	assert.NotNil(t, err)
+
+	store, err := NewReadonlyFile(filename, WithEncryptionKey([]byte("key-2")))
+	assert.Nil(t, err)
+	u, err := store.User("mary")
+	assert.Nil(t, err)
+	assert.Equal(t, "3UFC3DUK27KESHBWEJDQS4B2HXLHGFZV", u.Secret)
+}
@@ -0,0 +1,276 @@
+package totp
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// inviteAudience marks a token as an invitation, so no other token signed with the key is accepted as one
+	inviteAudience = "totp-invite"
+
+	// enrollAudience marks a token as an enrollment in progress; an invitation plus the new secret
+	enrollAudience = "totp-enroll"
+
+	// enrollTTL is how long a user has to confirm a code once they've opened their invitation
+	enrollTTL = 15 * time.Minute
+)
+
+// inviteClaims are the claims of invitation & enrollment tokens.
+type inviteClaims struct {
+	Username    string   `json:"username"`
+	Groups      []string `json:"groups,omitempty"`
+	DisplayName string   `json:"name,omitempty"`
+	Email       string   `json:"email,omitempty"`
+	Secret      string   `json:"secret,omitempty"` // enrollment tokens only
+
+	// InviteExpiresAt is when the invitation expires, for enrollment tokens, which expire sooner
+	InviteExpiresAt int64 `json:"invite_exp,omitempty"`
+	jwt.StandardClaims
+}
+
+// enrollPage is the data available to the enroll template.
+type enrollPage struct {
+	// EnrollURL is where the form should be POSTed
+	EnrollURL string
+
+	// Token to be sent back as the "enrollment" field
+	Token string
+
+	// Username being enrolled
+	Username string
+
+	// QRCode is a data: URL of a PNG QR code of the new secret, for authenticator apps
+	QRCode template.URL
+
+	// Secret for entering into authenticator apps by hand
+	Secret string
+
+	// Error describes why the last code wasn't accepted, if it wasn't
+	Error string
+
+	// Done is set once the user has been created, along with where to log in
+	Done     bool
+	LoginURL string
+}
+
+// NewInvitation creates a signed invitation for a user to enroll themselves (see WithInviteKey), valid for ttl.
+// The user's groups & details are set on the user once they enroll; their secret is ignored.
+func NewInvitation(key []byte, user *User, ttl time.Duration) (string, error) {
+	if user.Username == "" {
+		return "", errors.New("username is required")
+	}
+	if len(key) == 0 {
+		return "", errors.New("invite key is required")
+	}
+	id, err := randBytes(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := &inviteClaims{
+		Username:    user.Username,
+		Groups:      user.Groups,
+		DisplayName: user.DisplayName,
+		Email:       user.Email,
+		StandardClaims: jwt.StandardClaims{
+			Id:        fmt.Sprintf("%x", id),
+			Audience:  inviteAudience,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(ttl).Unix(),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(key)
+}
+
+// parseInviteToken validates an invitation or enrollment token, requiring the given audience.
+func parseInviteToken(key []byte, token, audience string) (*inviteClaims, error) {
+	claims := &inviteClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodHS256 {
+			return nil, errors.New("unexpected signing method")
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !claims.VerifyAudience(audience, true) {
+		return nil, errors.New("wrong token type")
+	}
+	if claims.Id == "" {
+		return nil, errors.New("token has no ID")
+	}
+	return claims, nil
+}
+
+// authEnroll is the handler for the /auth/enroll endpoint.
+// GET with an ?invite= token shows the user a new TOTP secret (and QR code).
+// POST confirms the user has set up the secret with a valid code, and creates the user.
+func (s *server) authEnroll(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		s.enrollGet(w, r)
+		return
+	} else if r.Method == http.MethodPost {
+		s.enrollPost(w, r)
+		return
+	}
+	log.Println("Method not allowed", r.Method)
+	s.writeErrorPage(w, "No", http.StatusMethodNotAllowed)
+}
+
+// enrollGet checks the invitation and generates the user's secret, which is carried (signed) in the form.
+func (s *server) enrollGet(w http.ResponseWriter, r *http.Request) {
+	invite, err := parseInviteToken(s.inviteKey, r.URL.Query().Get("invite"), inviteAudience)
+	if err != nil {
+		log.Println("Invalid invitation:", err)
+		s.writeErrorPage(w, "This invitation is invalid or has expired", http.StatusUnauthorized)
+		return
+	}
+	if !s.canEnroll(w, invite) {
+		return
+	}
+
+	secret, _, qr, err := NewTOTP(s.issuer, invite.Username)
+	if err != nil {
+		log.Println("Error generating TOTP:", err)
+		s.writeErrorPage(w, msgInternalError, http.StatusInternalServerError)
+		return
+	}
+
+	// the user has until the invitation expires, or enrollTTL, whichever is sooner
+	enroll := *invite
+	enroll.Secret = secret
+	enroll.Audience = enrollAudience
+	enroll.InviteExpiresAt = invite.ExpiresAt
+	enroll.IssuedAt = time.Now().Unix()
+	if expires := time.Now().Add(enrollTTL).Unix(); expires < enroll.ExpiresAt {
+		enroll.ExpiresAt = expires
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &enroll).SignedString(s.inviteKey)
+	if err != nil {
+		log.Println("Error signing enrollment:", err)
+		s.writeErrorPage(w, msgInternalError, http.StatusInternalServerError)
+		return
+	}
+
+	s.renderTemplate(w, enrollTemplate, s.newEnrollPage(token, &enroll, qr), http.StatusOK)
+}
+
+// enrollPost checks the code the user gives us against their new secret, and if it's valid creates them.
+func (s *server) enrollPost(w http.ResponseWriter, r *http.Request) {
+	token := r.PostFormValue("enrollment")
+	enroll, err := parseInviteToken(s.inviteKey, token, enrollAudience)
+	if err != nil || enroll.Secret == "" {
+		log.Println("Invalid enrollment:", err)
+		s.writeErrorPage(w, "This enrollment has expired, please open your invitation again", http.StatusUnauthorized)
+		return
+	}
+	if !s.canEnroll(w, enroll) {
+		return
+	}
+	// rate limited like logins, as the invited user (who can't choose their username)
+	if !s.allowLogin(r, enroll.Username) {
+		s.writeErrorPage(w, failureRateLimited.message(), http.StatusTooManyRequests)
+		return
+	}
+
+	user := &User{
+		Username:    enroll.Username,
+		Secret:      enroll.Secret,
+		Groups:      enroll.Groups,
+		DisplayName: enroll.DisplayName,
+		Email:       enroll.Email,
+	}
+	code := strings.Replace(r.PostFormValue("token"), " ", "", -1)
+	step, ok := validateTOTP(user, code, time.Now())
+	if !ok {
+		log.Println("Invalid enrollment code:", user.Username)
+		qr, err := totpQRCode(s.issuer, user.Username, user.Secret, user.TOTPOptions)
+		if err != nil {
+			log.Println("Error generating QR code:", err)
+		}
+		page := s.newEnrollPage(token, enroll, qr)
+		page.Error = "That code wasn't valid, please check your authenticator app and try again"
+		s.renderTemplate(w, enrollTemplate, page, http.StatusUnauthorized)
+		return
+	}
+
+	err = s.store.(WritableStorage).CreateUser(user)
+	if errors.Is(err, ErrUserExists) {
+		s.writeErrorPage(w, "You have already enrolled, please log in", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println("Error creating user:", err)
+		s.writeErrorPage(w, msgInternalError, http.StatusInternalServerError)
+		return
+	}
+	// nor should the invitation be used again, eg. if the user is deleted
+	err = s.revocations.Revoke(enroll.Id, time.Unix(enroll.InviteExpiresAt, 0))
+	if err != nil {
+		log.Println("Error recording invitation as used:", err)
+	}
+	// the code we just checked shouldn't also be accepted for logging in
+	_, err = s.replay.Accept(user.Username, step)
+	if err != nil {
+		log.Println("Error recording TOTP step:", err)
+	}
+
+	log.Println("User enrolled:", user.Username)
+	_, span := tracer.Start(r.Context(), "enrolled")
+	span.AddEvent("User created")
+	span.SetAttributes(attribute.String("user", user.Username))
+	span.End()
+
+	s.renderTemplate(w, enrollTemplate, &enrollPage{Username: user.Username, Done: true, LoginURL: s.authLoginURL}, http.StatusOK)
+}
+
+// canEnroll checks the invitation hasn't been used and the user doesn't already exist, writing an error page
+// if either has happened (or we can't tell). Used invitations are recorded in the revocation store by ID.
+func (s *server) canEnroll(w http.ResponseWriter, invite *inviteClaims) bool {
+	used, err := s.revocations.Revoked(&JWTClaim{StandardClaims: jwt.StandardClaims{Id: invite.Id}})
+	if err != nil {
+		log.Println("Error checking invitation:", err)
+		s.writeErrorPage(w, msgInternalError, http.StatusInternalServerError)
+		return false
+	} else if used {
+		log.Println("Invitation already used:", invite.Username)
+		s.writeErrorPage(w, "This invitation has already been used", http.StatusConflict)
+		return false
+	}
+
+	_, err = s.store.User(invite.Username)
+	if err == nil {
+		s.writeErrorPage(w, "You have already enrolled, please log in", http.StatusConflict)
+		return false
+	} else if !errors.Is(err, ErrUserNotFound) {
+		log.Println("Error loading user:", err)
+		s.writeErrorPage(w, msgInternalError, http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// newEnrollPage returns the data for the enroll template, for an enrollment in progress.
+func (s *server) newEnrollPage(token string, enroll *inviteClaims, qr []byte) *enrollPage {
+	page := &enrollPage{
+		EnrollURL: s.authEnrollURL,
+		Token:     token,
+		Username:  enroll.Username,
+		Secret:    enroll.Secret,
+		LoginURL:  s.authLoginURL,
+	}
+	if len(qr) > 0 {
+		page.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(qr))
+	}
+	return page
+}
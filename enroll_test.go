@@ -0,0 +1,177 @@
+package totp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvitation(t *testing.T) {
+	key := []byte("invite-key")
+	token, err := NewInvitation(key, &User{Username: "alice", Groups: []string{"dev"}}, time.Hour)
+	assert.Nil(t, err)
+
+	claims, err := parseInviteToken(key, token, inviteAudience)
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", claims.Username)
+	assert.Equal(t, []string{"dev"}, claims.Groups)
+
+	// only for its purpose, and only with the right key
+	_, err = parseInviteToken(key, token, enrollAudience)
+	assert.NotNil(t, err)
+	_, err = parseInviteToken([]byte("other"), token, inviteAudience)
+	assert.NotNil(t, err)
+
+	// other tokens signed with the key aren't invitations
+	csrf, err := newJWT(key, "alice", time.Hour)
+	assert.Nil(t, err)
+	_, err = parseInviteToken(key, csrf, inviteAudience)
+	assert.NotNil(t, err)
+
+	_, err = NewInvitation(key, &User{}, time.Hour)
+	assert.NotNil(t, err)
+}
+
+func TestEnroll(t *testing.T) {
+	store, err := NewWritableFile(copyTestConfig(t))
+	assert.Nil(t, err)
+	key := []byte("invite-key")
+	s := newTestServer(t, WithStorage(store), WithInviteKey(key), WithSecondsBetweenLogins(0))
+	h := s.newHTTPHandler()
+
+	invite, err := NewInvitation(key, &User{Username: "alice", Groups: []string{"dev"}, Email: "alice@example.com"}, time.Hour)
+	assert.Nil(t, err)
+
+	// opening the invitation shows a new secret
+	req := httptest.NewRequest(http.MethodGet, s.authEnrollURL+"?invite="+url.QueryEscape(invite), nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `src="data:image/png;base64,`)
+	secret := regexp.MustCompile(`<code>([A-Z2-7]+)</code>`).FindStringSubmatch(w.Body.String())
+	enrollment := regexp.MustCompile(`name="enrollment" value="([^"]+)"`).FindStringSubmatch(w.Body.String())
+	if !assert.Len(t, secret, 2) || !assert.Len(t, enrollment, 2) {
+		return
+	}
+
+	confirm := func(code string) *httptest.ResponseRecorder {
+		form := url.Values{"token": {code}, "enrollment": {enrollment[1]}}
+		req := httptest.NewRequest(http.MethodPost, s.authEnrollURL, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = "198.51.100.1:1234"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// a wrong code doesn't create the user
+	w = confirm("000000")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), secret[1])
+	_, err = store.User("alice")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	// the right one does
+	code, err := totp.GenerateCode(secret[1], time.Now())
+	assert.Nil(t, err)
+	w = confirm(code)
+	assert.Equal(t, http.StatusOK, w.Code)
+	u, err := store.User("alice")
+	assert.Nil(t, err)
+	assert.Equal(t, secret[1], u.Secret)
+	assert.Equal(t, []string{"dev"}, u.Groups)
+	assert.Equal(t, "alice@example.com", u.Email)
+
+	// the code used to enroll can't be used to log in
+	w = loginWithCSRF(t, s, "alice", code)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// invitations only work once
+	req = httptest.NewRequest(http.MethodGet, s.authEnrollURL+"?invite="+url.QueryEscape(invite), nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// even once the user is deleted
+	assert.Nil(t, store.DeleteUser("alice"))
+	req = httptest.NewRequest(http.MethodGet, s.authEnrollURL+"?invite="+url.QueryEscape(invite), nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "already been used")
+	w = confirm(code)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	_, err = store.User("alice")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	// nor do forged ones
+	forged, err := NewInvitation([]byte("guess"), &User{Username: "bob"}, time.Hour)
+	assert.Nil(t, err)
+	req = httptest.NewRequest(http.MethodGet, s.authEnrollURL+"?invite="+url.QueryEscape(forged), nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestEnrollRateLimitedPerUser(t *testing.T) {
+	store, err := NewWritableFile(copyTestConfig(t))
+	assert.Nil(t, err)
+	key := []byte("invite-key")
+	s := newTestServer(t, WithStorage(store), WithInviteKey(key), WithRateLimitKey(RateLimitByUser), WithLoginBurst(1), WithSecondsBetweenLogins(3600))
+	h := s.newHTTPHandler()
+
+	confirm := func(username string) int {
+		invite, err := NewInvitation(key, &User{Username: username}, time.Hour)
+		assert.Nil(t, err)
+		req := httptest.NewRequest(http.MethodGet, s.authEnrollURL+"?invite="+url.QueryEscape(invite), nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		enrollment := regexp.MustCompile(`name="enrollment" value="([^"]+)"`).FindStringSubmatch(w.Body.String())
+		if !assert.Len(t, enrollment, 2) {
+			return 0
+		}
+
+		form := url.Values{"token": {"000000"}, "enrollment": {enrollment[1]}}
+		req = httptest.NewRequest(http.MethodPost, s.authEnrollURL, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// one user's attempts don't hold up another's
+	assert.Equal(t, http.StatusUnauthorized, confirm("alice"))
+	assert.Equal(t, http.StatusTooManyRequests, confirm("alice"))
+	assert.Equal(t, http.StatusUnauthorized, confirm("bob"))
+}
+
+func TestEnrollRequiresOwnKey(t *testing.T) {
+	store, err := NewWritableFile(copyTestConfig(t))
+	assert.Nil(t, err)
+	for key, ok := range map[string]bool{"invite-key": true, "test-csrf-key": false, "test-jwt-key": false} {
+		_, err := buildServer(
+			WithCSRFKey([]byte("test-csrf-key")),
+			WithJWTKey([]byte("test-jwt-key")),
+			WithStorage(store),
+			WithInviteKey([]byte(key)),
+		)
+		assert.Equal(t, ok, err == nil, key)
+	}
+}
+
+func TestEnrollRequiresWritableStorage(t *testing.T) {
+	_, err := buildServer(
+		WithCSRFKey([]byte("test-csrf-key")),
+		WithJWTKey([]byte("test-jwt-key")),
+		WithStorage(NewDebugStorage()),
+		WithInviteKey([]byte("invite-key")),
+	)
+	assert.NotNil(t, err)
+}
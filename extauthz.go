@@ -0,0 +1,143 @@
+package totp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// extAuthzServer is an Envoy ext_authz (envoy.service.auth.v3.Authorization) gRPC service.
+// It makes the same decision as /auth/forward; logged in users are allowed with identity headers
+// added to the upstream request, everyone else is redirected to the login page.
+type extAuthzServer struct {
+	authv3.UnimplementedAuthorizationServer
+	s *server
+}
+
+// newGRPCServer creates a gRPC server with the ext_authz service registered.
+func (s *server) newGRPCServer() *grpc.Server {
+	g := grpc.NewServer()
+	authv3.RegisterAuthorizationServer(g, &extAuthzServer{s: s})
+	return g
+}
+
+// Check implements authv3.AuthorizationServer.
+func (e *extAuthzServer) Check(ctx context.Context, req *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	r := checkRequestToHTTP(ctx, req, e.s.cookieName)
+
+	claims, status := e.s.authorize(r, forwardedHeaders)
+	switch status {
+	case http.StatusOK:
+		h := http.Header{}
+		e.s.setIdentityHeaders(h, claims)
+		return &authv3.CheckResponse{
+			Status: &rpcstatus.Status{Code: int32(codes.OK)},
+			HttpResponse: &authv3.CheckResponse_OkResponse{
+				OkResponse: &authv3.OkHttpResponse{Headers: headerOptions(h), HeadersToRemove: e.unsetIdentityHeaders(h)},
+			},
+		}, nil
+	case http.StatusUnauthorized:
+		h := http.Header{}
+		h.Set("Location", e.s.forwardLoginURL(r))
+		return deniedResponse(codes.Unauthenticated, typev3.StatusCode_Found, h), nil
+	case http.StatusForbidden:
+		return deniedResponse(codes.PermissionDenied, typev3.StatusCode_Forbidden, nil), nil
+	}
+	return deniedResponse(codes.InvalidArgument, typev3.StatusCode_BadRequest, nil), nil
+}
+
+// clientAddressKey marks requests whose RemoteAddr is the client's own address, as reported by Envoy,
+// rather than that of a proxy in front of us.
+type clientAddressKey struct{}
+
+// checkRequestToHTTP describes the request Envoy is checking as an HTTP request to /auth/forward, so we can
+// make the decision in the same way. We only copy across the session cookie & Authorization header (for bearer
+// tokens); other headers are ignored so clients can't claim a different original request.
+// The client's address (for rate limits & lockouts) is the source address Envoy reports.
+func checkRequestToHTTP(ctx context.Context, req *authv3.CheckRequest, cookieName string) *http.Request {
+	attrs := req.GetAttributes().GetRequest().GetHttp()
+
+	r := (&http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Path: "/"},
+		Header: http.Header{},
+	}).WithContext(ctx)
+	if source := req.GetAttributes().GetSource().GetAddress().GetSocketAddress(); source != nil {
+		r.RemoteAddr = net.JoinHostPort(source.GetAddress(), strconv.Itoa(int(source.GetPortValue())))
+		r = r.WithContext(context.WithValue(ctx, clientAddressKey{}, true))
+	}
+
+	// Envoy lower cases header names
+	original := http.Request{Header: http.Header{}}
+	if cookie := attrs.GetHeaders()["cookie"]; cookie != "" {
+		original.Header.Set("Cookie", cookie)
+	}
+	if c, err := original.Cookie(cookieName); err == nil {
+		r.AddCookie(c)
+	}
+	if auth := attrs.GetHeaders()["authorization"]; auth != "" {
+		r.Header.Set("Authorization", auth)
+	}
+
+	scheme := attrs.GetScheme()
+	if scheme == "" {
+		scheme = "https"
+	}
+	r.Header.Set("X-Forwarded-Method", attrs.GetMethod())
+	r.Header.Set("X-Forwarded-Proto", scheme)
+	r.Header.Set("X-Forwarded-Host", attrs.GetHost())
+	r.Header.Set("X-Forwarded-Uri", attrs.GetPath())
+	return r
+}
+
+// unsetIdentityHeaders returns the configured identity headers not in h (eg. the groups header for a user
+// without groups), for Envoy to remove so clients can't send their own. Headers in h already replace the client's;
+// we don't remove them too as Envoy doesn't say whether removing happens before or after setting.
+func (e *extAuthzServer) unsetIdentityHeaders(h http.Header) []string {
+	remove := []string{}
+	for _, name := range []string{e.s.userHeader, e.s.groupsHeader, e.s.expiresHeader} {
+		if name != "" && h.Get(name) == "" {
+			remove = append(remove, name)
+		}
+	}
+	return remove
+}
+
+// deniedResponse returns a CheckResponse telling Envoy to deny the request with the given HTTP status & headers.
+func deniedResponse(code codes.Code, status typev3.StatusCode, h http.Header) *authv3.CheckResponse {
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(code)},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{
+			DeniedResponse: &authv3.DeniedHttpResponse{
+				Status:  &typev3.HttpStatus{Code: status},
+				Headers: headerOptions(h),
+				Body:    http.StatusText(int(status)),
+			},
+		},
+	}
+}
+
+// headerOptions converts HTTP headers to Envoy header options. Headers replace any the client sent,
+// rather than being appended, so clients can't add to the identity we pass upstream.
+func headerOptions(h http.Header) []*corev3.HeaderValueOption {
+	opts := []*corev3.HeaderValueOption{}
+	for key, values := range h {
+		for _, v := range values {
+			opts = append(opts, &corev3.HeaderValueOption{
+				Header: &corev3.HeaderValue{Key: key, Value: v},
+				Append: wrapperspb.Bool(false),
+			})
+		}
+	}
+	return opts
+}
@@ -0,0 +1,116 @@
+package totp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestAuthzClient serves the ext_authz service over an in memory connection, returning a client for it.
+func newTestAuthzClient(t *testing.T, s *server) authv3.AuthorizationClient {
+	lis := bufconn.Listen(1024 * 1024)
+	g := s.newGRPCServer()
+	go g.Serve(lis)
+	t.Cleanup(g.Stop)
+
+	conn, err := grpc.NewClient(
+		"passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	assert.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return authv3.NewAuthorizationClient(conn)
+}
+
+func TestExtAuthz(t *testing.T) {
+	policy, err := NewPolicy([]*PolicyRule{
+		{Path: "/admin/", Users: []string{"mary"}},
+		{Path: "/", Users: []string{PolicyAnyUser}},
+	})
+	assert.Nil(t, err)
+	s := newTestServer(t, WithPolicy(policy), WithLoginRedirectURL("https://auth.example.com/auth/login"))
+	client := newTestAuthzClient(t, s)
+
+	check := func(user, path string) *authv3.CheckResponse {
+		headers := map[string]string{"x-auth-user": "someone-else", "x-auth-groups": "admin"}
+		if user != "" {
+			token, err := newSignedJWT(s.jwtKeys.Active(), user, time.Hour)
+			assert.Nil(t, err)
+			headers["cookie"] = "other=1; " + s.cookieName + "=" + token
+		}
+		resp, err := client.Check(context.Background(), &authv3.CheckRequest{
+			Attributes: &authv3.AttributeContext{
+				Request: &authv3.AttributeContext_Request{
+					Http: &authv3.AttributeContext_HttpRequest{
+						Method:  http.MethodGet,
+						Scheme:  "https",
+						Host:    "app.example.com",
+						Path:    path,
+						Headers: headers,
+					},
+				},
+			},
+		})
+		assert.Nil(t, err)
+		return resp
+	}
+
+	// not logged in, redirected to login
+	resp := check("", "/x?y=1")
+	assert.Equal(t, int32(codes.Unauthenticated), resp.GetStatus().GetCode())
+	denied := resp.GetDeniedResponse()
+	assert.Equal(t, typev3.StatusCode_Found, denied.GetStatus().GetCode())
+	if assert.Len(t, denied.GetHeaders(), 1) {
+		assert.Equal(t, "Location", denied.GetHeaders()[0].GetHeader().GetKey())
+		assert.Equal(t, "https://auth.example.com/auth/login?rd="+url.QueryEscape("https://app.example.com/x?y=1"), denied.GetHeaders()[0].GetHeader().GetValue())
+	}
+
+	// logged in, identity headers replace any the client sent
+	resp = check("mary", "/admin/")
+	assert.Equal(t, int32(codes.OK), resp.GetStatus().GetCode())
+	headers := map[string]string{}
+	for _, h := range resp.GetOkResponse().GetHeaders() {
+		headers[h.GetHeader().GetKey()] = h.GetHeader().GetValue()
+		assert.False(t, h.GetAppend().GetValue())
+	}
+	assert.Equal(t, "mary", headers["X-Auth-User"])
+	assert.Contains(t, headers, "X-Auth-Expires")
+
+	// .. and those we don't set (mary has no groups) are removed
+	assert.NotContains(t, headers, "X-Auth-Groups")
+	assert.Equal(t, []string{"X-Auth-Groups"}, resp.GetOkResponse().GetHeadersToRemove())
+
+	// denied by policy
+	resp = check("james", "/admin/")
+	assert.Equal(t, int32(codes.PermissionDenied), resp.GetStatus().GetCode())
+	assert.Equal(t, typev3.StatusCode_Forbidden, resp.GetDeniedResponse().GetStatus().GetCode())
+}
+
+func TestCheckRequestToHTTPSource(t *testing.T) {
+	req := &authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{
+			Source: &authv3.AttributeContext_Peer{
+				Address: &corev3.Address{Address: &corev3.Address_SocketAddress{SocketAddress: &corev3.SocketAddress{
+					Address:       "2001:db8::1",
+					PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: 1234},
+				}}},
+			},
+		},
+	}
+	r := checkRequestToHTTP(context.Background(), req, "totp-auth")
+	assert.Equal(t, "[2001:db8::1]:1234", r.RemoteAddr)
+	assert.Equal(t, "2001:db8::1", clientIP(r, ""))
+}
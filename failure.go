@@ -0,0 +1,105 @@
+package totp
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// loginFailureHeader is the response header telling clients (and tests, monitoring ..) why a login failed.
+const loginFailureHeader = "X-Login-Failure"
+
+// loginFailure is a machine readable reason a login failed.
+type loginFailure string
+
+const (
+	// failureInvalidRequest means the form couldn't be parsed
+	failureInvalidRequest loginFailure = "invalid_request"
+
+	// failureFormExpired means the CSRF token was invalid, expired or already used
+	failureFormExpired loginFailure = "form_expired"
+
+	// failureInvalidCode covers every reason the username & code weren't accepted (unknown or
+	// disabled user, wrong or reused code ..) so as not to reveal which usernames exist
+	failureInvalidCode loginFailure = "invalid_code"
+
+	// failureLockedOut means the user or client failed too many times, and must wait
+	failureLockedOut loginFailure = "locked_out"
+
+	// failureRateLimited means the client is making attempts too quickly
+	failureRateLimited loginFailure = "rate_limited"
+
+	// failureInternal means something went wrong on our side
+	failureInternal loginFailure = "internal_error"
+)
+
+// msgInternalError is shown when something went wrong on our side.
+const msgInternalError = "Something went wrong, please try again"
+
+// message returns what we tell the user. These are deliberately vague about why a code
+// wasn't accepted, so they don't reveal which usernames exist.
+func (f loginFailure) message() string {
+	switch f {
+	case failureInvalidRequest:
+		return "Invalid request"
+	case failureFormExpired:
+		return "The login form expired, please try again"
+	case failureLockedOut:
+		return "Too many failed logins"
+	case failureRateLimited:
+		return "Too many login attempts, please slow down"
+	case failureInternal:
+		return msgInternalError
+	}
+	return "Invalid username or code"
+}
+
+// status returns the HTTP status we respond with.
+func (f loginFailure) status() int {
+	switch f {
+	case failureInvalidRequest:
+		return http.StatusBadRequest
+	case failureLockedOut, failureRateLimited:
+		return http.StatusTooManyRequests
+	case failureInternal:
+		return http.StatusInternalServerError
+	}
+	return http.StatusUnauthorized
+}
+
+// sendLoginFailure re-renders the login page explaining why the login failed, and records the reason
+// in a response header & on the request's span. If wait is given, that's how long before the client may retry.
+func (s *server) sendLoginFailure(w http.ResponseWriter, r *http.Request, reason loginFailure, wait time.Duration) {
+	wait = setLoginFailureHeaders(w, r, reason, wait)
+	s.sendLoginPage(w, r, reason.status(), &loginPage{Reason: string(reason), Error: reason.message(), LockoutRemaining: wait})
+}
+
+// sendLoginFailureJSON is sendLoginFailure for the JSON login API, responding {"error": reason, "message": msg}
+// (and "retry_after" in seconds, if wait is given).
+func sendLoginFailureJSON(w http.ResponseWriter, r *http.Request, reason loginFailure, wait time.Duration) {
+	wait = setLoginFailureHeaders(w, r, reason, wait)
+	body := map[string]interface{}{"error": string(reason), "message": reason.message()}
+	if wait > 0 {
+		body["retry_after"] = int(wait.Seconds())
+	}
+	writeJSON(w, body, reason.status())
+}
+
+// setLoginFailureHeaders records the reason a login failed in a response header & on the request's span,
+// and sets Retry-After if wait is given. Returns wait rounded to the (whole, at least one) seconds sent.
+func setLoginFailureHeaders(w http.ResponseWriter, r *http.Request, reason loginFailure, wait time.Duration) time.Duration {
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("login.failure_reason", string(reason)))
+
+	w.Header().Set(loginFailureHeader, string(reason))
+	if wait > 0 {
+		wait = wait.Round(time.Second)
+		if wait < time.Second {
+			wait = time.Second
+		}
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(wait.Seconds())))
+	}
+	return wait
+}
@@ -1,41 +1,282 @@
 package totp
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"math/big"
 	"time"
 
 	"github.com/golang-jwt/jwt"
 )
 
+const (
+	// sessionAudience marks a token as a session, so no other token signed with the key is accepted as one
+	sessionAudience = "totp-session"
+
+	// csrfAudience marks a token as a (login or logout) form's CSRF token
+	csrfAudience = "totp-csrf"
+)
+
 // Claims we want to store in the JWT
 type JWTClaim struct {
-	Username string `json:"username"`
+	Username    string            `json:"username"`
+	Groups      []string          `json:"groups,omitempty"`
+	DisplayName string            `json:"name,omitempty"`
+	Email       string            `json:"email,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	ReturnTo    string            `json:"rd,omitempty"` // CSRF tokens only, where to go after login
 	jwt.StandardClaims
 }
 
-// newJWT creates a new JWT token with the given username and expiration time.
+// JWTKey is a key used to sign and/or verify JWTs.
+type JWTKey struct {
+	// ID is sent as the "kid" header of tokens we sign, so verifiers know which key to use.
+	// Empty for (legacy) shared secret keys.
+	ID string
+
+	method    jwt.SigningMethod
+	signKey   interface{} // nil if we can only verify with this key
+	verifyKey interface{}
+}
+
+// NewHMACJWTKey creates a HS256 key from a shared secret.
+// Anyone able to verify tokens signed with this key can also forge them.
+func NewHMACJWTKey(id string, secret []byte) *JWTKey {
+	return &JWTKey{ID: id, method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret}
+}
+
+// ParsePEMJWTKey parses a PEM encoded key. Private keys (RSA, ECDSA P-256/384/521 or Ed25519, in
+// PKCS#8, PKCS#1 or SEC 1 form) can sign & verify, public keys (PKIX) can only verify.
+// If id is empty the RFC 7638 thumbprint of the public key is used.
+func ParsePEMJWTKey(id string, data []byte) (*JWTKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var private, public interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		private, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		public, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if private != nil {
+		signer, ok := private.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", private)
+		}
+		public = signer.Public()
+	}
+
+	k := &JWTKey{ID: id, verifyKey: public}
+	switch pub := public.(type) {
+	case *rsa.PublicKey:
+		k.method = jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			k.method = jwt.SigningMethodES256
+		case elliptic.P384():
+			k.method = jwt.SigningMethodES384
+		case elliptic.P521():
+			k.method = jwt.SigningMethodES512
+		default:
+			return nil, errors.New("unsupported elliptic curve")
+		}
+	case ed25519.PublicKey:
+		k.method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", public)
+	}
+	if private != nil {
+		k.signKey = private
+	}
+
+	if k.ID == "" {
+		k.ID, err = k.thumbprint()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// Algorithm returns the JWT "alg" this key signs with (eg. RS256)
+func (k *JWTKey) Algorithm() string {
+	return k.method.Alg()
+}
+
+// CanSign returns if we hold the private (or shared) key, as opposed to only being able to verify.
+func (k *JWTKey) CanSign() bool {
+	return k.signKey != nil
+}
+
+// hasSecret returns if this is a shared secret key with the given secret.
+func (k *JWTKey) hasSecret(secret []byte) bool {
+	s, ok := k.verifyKey.([]byte)
+	return ok && bytes.Equal(s, secret)
+}
+
+// empty returns if this is a shared secret key with no secret, which anyone could forge tokens with.
+func (k *JWTKey) empty() bool {
+	secret, ok := k.verifyKey.([]byte)
+	return ok && len(secret) == 0
+}
+
+// JWK returns the public part of the key as a JSON Web Key (RFC 7517).
+// Returns nil for shared secret keys, since there is no public part.
+func (k *JWTKey) JWK() map[string]string {
+	jwk := publicJWK(k.verifyKey)
+	if jwk == nil {
+		return nil
+	}
+	jwk["kid"] = k.ID
+	jwk["alg"] = k.method.Alg()
+	jwk["use"] = "sig"
+	return jwk
+}
+
+// thumbprint returns the RFC 7638 thumbprint of the public key.
+func (k *JWTKey) thumbprint() (string, error) {
+	jwk := publicJWK(k.verifyKey)
+	if jwk == nil {
+		return "", errors.New("key has no public part")
+	}
+	// json.Marshal sorts map keys, giving us the required lexicographic order
+	data, err := json.Marshal(jwk)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// publicJWK returns the required JWK members for a public key, or nil if it isn't one.
+func publicJWK(key interface{}) map[string]string {
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{
+			"kty": "RSA",
+			"n":   b64(pub.N.Bytes()),
+			"e":   b64(big.NewInt(int64(pub.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		return map[string]string{
+			"kty": "EC",
+			"crv": pub.Curve.Params().Name,
+			"x":   b64(pub.X.FillBytes(make([]byte, size))),
+			"y":   b64(pub.Y.FillBytes(make([]byte, size))),
+		}
+	case ed25519.PublicKey:
+		return map[string]string{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"x":   b64(pub),
+		}
+	}
+	return nil
+}
+
+// newJWT creates a new CSRF token with the given username and expiration time, signed with a shared key.
 func newJWT(key []byte, username string, ttl time.Duration) (string, error) {
+	return signClaims(NewHMACJWTKey("", key), csrfAudience, &JWTClaim{Username: username}, ttl)
+}
+
+// newSignedJWT creates a new session JWT with the given username and expiration time, signed with the given key.
+func newSignedJWT(key *JWTKey, username string, ttl time.Duration) (string, error) {
+	return signClaims(key, sessionAudience, &JWTClaim{Username: username}, ttl)
+}
+
+// newSessionJWT creates a new session JWT for the user, carrying their groups & details, signed with the given key.
+// Returns the token and its claims.
+func newSessionJWT(key *JWTKey, user *User, ttl time.Duration) (string, *JWTClaim, error) {
+	u := user.clone()
 	claims := &JWTClaim{
-		Username: username,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(ttl).Unix(),
-		},
+		Username:    u.Username,
+		Groups:      u.Groups,
+		DisplayName: u.DisplayName,
+		Email:       u.Email,
+		Attributes:  u.Attributes,
+	}
+	token, err := signClaims(key, sessionAudience, claims, ttl)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, claims, nil
+}
+
+// signClaims sets the ID, audience, issue & expiration time of the claims and signs them with the given key.
+func signClaims(key *JWTKey, audience string, claims *JWTClaim, ttl time.Duration) (string, error) {
+	if !key.CanSign() {
+		return "", errors.New("key can only be used for verification")
+	}
+	id, err := randBytes(16)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims.StandardClaims = jwt.StandardClaims{
+		Id:        fmt.Sprintf("%x", id),
+		Audience:  audience,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}
+	token := jwt.NewWithClaims(key.method, claims)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(key)
+	return token.SignedString(key.signKey)
 }
 
-// validateJWT checks the given token and returns the claims if it's valid.
+// validateJWT checks the given CSRF token (signed with a shared key) and returns the claims if it's valid.
 func validateJWT(key []byte, signedToken string) (*JWTClaim, error) {
+	return validateSignedJWT([]*JWTKey{NewHMACJWTKey("", key)}, signedToken, csrfAudience)
+}
+
+// validateSignedJWT checks the given token against our keys and returns the claims if it's valid.
+// The key is chosen by the token's "kid" header, and the token must use that key's algorithm
+// and be for the given audience.
+func validateSignedJWT(keys []*JWTKey, signedToken, audience string) (*JWTClaim, error) {
 	token, err := jwt.ParseWithClaims(
 		signedToken, &JWTClaim{},
 		func(token *jwt.Token) (interface{}, error) {
-			if token.Method == nil {
-				return nil, errors.New("unexpected signing method")
-			} else if token.Method != jwt.SigningMethodHS256 {
-				return nil, errors.New("unexpected signing method")
+			kid, _ := token.Header["kid"].(string)
+			for _, k := range keys {
+				if k.ID != kid {
+					continue
+				}
+				// never trust the token's choice of algorithm, it must be the key's
+				if token.Method == nil || token.Method.Alg() != k.method.Alg() {
+					return nil, errors.New("unexpected signing method")
+				}
+				return k.verifyKey, nil
 			}
-			return []byte(key), nil
+			return nil, errors.New("unknown signing key")
 		},
 	)
 	if err != nil {
@@ -49,6 +290,9 @@ func validateJWT(key []byte, signedToken string) (*JWTClaim, error) {
 	if claims.ExpiresAt < time.Now().Local().Unix() {
 		return nil, errors.New("token expired")
 	}
+	if !claims.VerifyAudience(audience, true) {
+		return nil, errors.New("wrong token type")
+	}
 
 	return claims, nil
 }
@@ -1,6 +1,13 @@
 package totp
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"testing"
 	"time"
 
@@ -31,6 +38,9 @@ func TestJWT(t *testing.T) {
 	tokenExp, err := expiredJWT(secret, "expired-user")
 	assert.Nil(t, err)
 
+	tokenSession, err := newSignedJWT(NewHMACJWTKey("", secret), "session-user", time.Hour)
+	assert.Nil(t, err)
+
 	cases := []struct {
 		Name        string
 		Token       string
@@ -40,6 +50,7 @@ func TestJWT(t *testing.T) {
 		{"bad-user", "bad-token", true},
 		{"bad-smarter-user", tokenBad, true},
 		{"expired-user", tokenExp, true},
+		{"session-user", tokenSession, true},
 	}
 
 	for _, c := range cases {
@@ -54,3 +65,110 @@ func TestJWT(t *testing.T) {
 		})
 	}
 }
+
+// testPEMKeys generates one private key of each type we support, PEM encoded.
+func testPEMKeys(t *testing.T) map[string][]byte {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	result := map[string][]byte{}
+	for alg, key := range map[string]interface{}{"RS256": rsaKey, "ES256": ecKey, "EdDSA": edKey} {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		assert.Nil(t, err)
+		result[alg] = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	}
+	return result
+}
+
+func TestSignedJWT(t *testing.T) {
+	for alg, data := range testPEMKeys(t) {
+		t.Run(alg, func(t *testing.T) {
+			key, err := ParsePEMJWTKey("", data)
+			assert.Nil(t, err)
+			assert.Equal(t, alg, key.Algorithm())
+			assert.True(t, key.CanSign())
+			assert.NotEqual(t, "", key.ID) // thumbprint
+
+			jwk := key.JWK()
+			assert.Equal(t, key.ID, jwk["kid"])
+			assert.Equal(t, alg, jwk["alg"])
+			assert.NotContains(t, jwk, "d") // never the private part
+
+			token, err := newSignedJWT(key, "good-user", time.Hour)
+			assert.Nil(t, err)
+
+			result, err := validateSignedJWT([]*JWTKey{key}, token, sessionAudience)
+			assert.Nil(t, err)
+			assert.Equal(t, "good-user", result.Username)
+
+			// a different kid isn't accepted
+			other := *key
+			other.ID = "other"
+			_, err = validateSignedJWT([]*JWTKey{&other}, token, sessionAudience)
+			assert.NotNil(t, err)
+
+			// an HS256 token using the same kid isn't accepted (algorithm confusion)
+			forged, err := newSignedJWT(NewHMACJWTKey(key.ID, []byte("guess")), "bad-user", time.Hour)
+			assert.Nil(t, err)
+			_, err = validateSignedJWT([]*JWTKey{key}, forged, sessionAudience)
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestParsePEMJWTKeyPublic(t *testing.T) {
+	private, err := ParsePEMJWTKey("key-1", testPEMKeys(t)["ES256"])
+	assert.Nil(t, err)
+	assert.Equal(t, "key-1", private.ID)
+
+	der, err := x509.MarshalPKIXPublicKey(private.verifyKey)
+	assert.Nil(t, err)
+	public, err := ParsePEMJWTKey("key-1", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	assert.Nil(t, err)
+	assert.False(t, public.CanSign())
+
+	// public keys verify, but can't sign
+	token, err := newSignedJWT(private, "good-user", time.Hour)
+	assert.Nil(t, err)
+	_, err = validateSignedJWT([]*JWTKey{public}, token, sessionAudience)
+	assert.Nil(t, err)
+	_, err = newSignedJWT(public, "good-user", time.Hour)
+	assert.NotNil(t, err)
+
+	_, err = ParsePEMJWTKey("", []byte("not a pem"))
+	assert.NotNil(t, err)
+}
+
+func TestSessionJWT(t *testing.T) {
+	key := NewHMACJWTKey("", []byte("secret"))
+	user := &User{
+		Username:    "mary",
+		Secret:      "3UFC3DUK27KESHBWEJDQS4B2HXLHGFZV",
+		Groups:      []string{"admin", "dev"},
+		DisplayName: "Mary Smith",
+		Email:       "mary@example.com",
+		Attributes:  map[string]string{"team": "platform"},
+	}
+
+	token, claims, err := newSessionJWT(key, user, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, "mary", claims.Username)
+	result, err := validateSignedJWT([]*JWTKey{key}, token, sessionAudience)
+	assert.Nil(t, err)
+	assert.Equal(t, "mary", result.Username)
+	assert.Equal(t, []string{"admin", "dev"}, result.Groups)
+	assert.Equal(t, "Mary Smith", result.DisplayName)
+	assert.Equal(t, "mary@example.com", result.Email)
+	assert.Equal(t, map[string]string{"team": "platform"}, result.Attributes)
+	assert.NotEqual(t, "", result.Id)
+
+	// other tokens signed with the key aren't sessions
+	csrf, err := newJWT([]byte("secret"), "mary", time.Hour)
+	assert.Nil(t, err)
+	_, err = validateSignedJWT([]*JWTKey{key}, csrf, sessionAudience)
+	assert.NotNil(t, err)
+}
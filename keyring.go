@@ -0,0 +1,150 @@
+package totp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// JWTKeyring is the set of keys we sign & verify JWTs with. One active key signs new tokens,
+// while every key in the ring is accepted when verifying, so keys can be rotated without
+// logging everyone out: add a new key & make it active, then remove the old key once all
+// tokens signed with it have expired.
+type JWTKeyring struct {
+	active *JWTKey
+	keys   []*JWTKey
+}
+
+// NewJWTKeyring creates a keyring that signs with active & also accepts tokens signed by any of verify.
+// Key IDs must be unique.
+func NewJWTKeyring(active *JWTKey, verify ...*JWTKey) (*JWTKeyring, error) {
+	if active == nil {
+		return nil, errors.New("an active key is required")
+	}
+	if !active.CanSign() {
+		return nil, fmt.Errorf("active key %q can't sign (is it a public key?)", active.ID)
+	}
+
+	keys := append([]*JWTKey{active}, verify...)
+	seen := map[string]bool{}
+	for _, k := range keys {
+		if seen[k.ID] {
+			return nil, fmt.Errorf("duplicate key id %q", k.ID)
+		}
+		seen[k.ID] = true
+	}
+	return &JWTKeyring{active: active, keys: keys}, nil
+}
+
+// Active returns the key new tokens are signed with.
+func (r *JWTKeyring) Active() *JWTKey {
+	return r.active
+}
+
+// Keys returns all keys tokens are accepted from, the active key first.
+func (r *JWTKeyring) Keys() []*JWTKey {
+	return r.keys
+}
+
+// LoadJWTKeyringDir loads a keyring from a directory, where each file is a key named by its key ID
+//   - <kid>.pem a PEM private key (RSA, EC or Ed25519), or public key (verify only)
+//   - <kid>.key a shared secret (HS256)
+//
+// The key with ID activeID signs new tokens. If activeID is empty the last (by name) key that can
+// sign is used, so naming keys by date (eg. 2024-06-01.pem) means the newest key is active.
+// Hidden files & directories (eg. Kubernetes' ..data) are ignored.
+func LoadJWTKeyringDir(dir, activeID string) (*JWTKeyring, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []*JWTKey{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		info, err := os.Stat(path) // follows symlinks, as used by Kubernetes secret volumes
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		ext := filepath.Ext(name)
+		kid := strings.TrimSuffix(name, ext)
+		switch ext {
+		case ".pem":
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			k, err := ParsePEMJWTKey(kid, data)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+			}
+			keys = append(keys, k)
+		case ".key":
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, NewHMACJWTKey(kid, []byte(strings.TrimRight(string(data), " \r\n\t"))))
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys (*.pem or *.key) found in %s", dir)
+	}
+	return newKeyringWithActive(keys, activeID)
+}
+
+// LoadJWTKeyringEnv loads a keyring of shared secret (HS256) keys from a string of the form
+// "kid1:secret1,kid2:secret2" (eg. from an environment variable).
+// The key with ID activeID signs new tokens, if activeID is empty the last key (by ID) is used.
+func LoadJWTKeyringEnv(value, activeID string) (*JWTKeyring, error) {
+	keys := []*JWTKey{}
+	for i, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		// don't include the pair in errors, it's (or contains) a secret
+		kid, secret, ok := strings.Cut(pair, ":")
+		if !ok || kid == "" || secret == "" {
+			return nil, fmt.Errorf("invalid key at position %d, expected kid:secret", i+1)
+		}
+		keys = append(keys, NewHMACJWTKey(kid, []byte(secret)))
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no keys given")
+	}
+	return newKeyringWithActive(keys, activeID)
+}
+
+// newKeyringWithActive builds a keyring from keys, choosing the active key by ID or as the
+// last (by ID) key that can sign.
+func newKeyringWithActive(keys []*JWTKey, activeID string) (*JWTKeyring, error) {
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+
+	active := -1
+	for i, k := range keys {
+		if activeID == "" && k.CanSign() || activeID != "" && k.ID == activeID {
+			active = i
+		}
+	}
+	if active < 0 {
+		if activeID != "" {
+			return nil, fmt.Errorf("active key %q not found", activeID)
+		}
+		return nil, errors.New("no key able to sign tokens found")
+	}
+
+	verify := append(append([]*JWTKey{}, keys[:active]...), keys[active+1:]...)
+	return NewJWTKeyring(keys[active], verify...)
+}
@@ -0,0 +1,79 @@
+package totp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadJWTKeyringDir(t *testing.T) {
+	pems := testPEMKeys(t)
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "2024-01.key"), []byte("old-secret\n"), 0600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "2024-02.pem"), pems["ES256"], 0600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "README.txt"), []byte("ignored"), 0600))
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "..data"), 0700))
+
+	cases := []struct {
+		Name         string
+		Active       string
+		ExpectActive string
+		ExpectError  bool
+	}{
+		{"newest", "", "2024-02", false},
+		{"chosen", "2024-01", "2024-01", false},
+		{"missing", "2023-12", "", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			ring, err := LoadJWTKeyringDir(dir, c.Active)
+			if c.ExpectError {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, c.ExpectActive, ring.Active().ID)
+			assert.Equal(t, c.ExpectActive, ring.Keys()[0].ID)
+			assert.Len(t, ring.Keys(), 2)
+		})
+	}
+}
+
+func TestJWTKeyringRotation(t *testing.T) {
+	// a token signed before rotation ..
+	before, err := LoadJWTKeyringEnv("2024-01:old-secret", "")
+	assert.Nil(t, err)
+	token, err := newSignedJWT(before.Active(), "good-user", time.Hour)
+	assert.Nil(t, err)
+
+	// .. is still valid after a new key is added
+	after, err := LoadJWTKeyringEnv("2024-01:old-secret,2024-02:new-secret", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "2024-02", after.Active().ID)
+	result, err := validateSignedJWT(after.Keys(), token, sessionAudience)
+	assert.Nil(t, err)
+	assert.Equal(t, "good-user", result.Username)
+
+	// .. but not once the old key is removed
+	removed, err := LoadJWTKeyringEnv("2024-02:new-secret", "")
+	assert.Nil(t, err)
+	_, err = validateSignedJWT(removed.Keys(), token, sessionAudience)
+	assert.NotNil(t, err)
+}
+
+func TestNewJWTKeyring(t *testing.T) {
+	_, err := NewJWTKeyring(nil)
+	assert.NotNil(t, err)
+
+	_, err = NewJWTKeyring(NewHMACJWTKey("a", []byte("1")), NewHMACJWTKey("a", []byte("2")))
+	assert.NotNil(t, err)
+
+	_, err = LoadJWTKeyringEnv("a:1,no-secret", "")
+	assert.NotNil(t, err)
+	assert.NotContains(t, err.Error(), "no-secret")
+	assert.Contains(t, err.Error(), "position 2")
+}
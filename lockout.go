@@ -0,0 +1,91 @@
+package totp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+)
+
+// lockout tracks login failures by key (eg. username or client IP) and locks out keys that
+// fail too often, doubling the lockout each further failure (up to a maximum).
+// Failures are forgotten after a quiet period, and the number of keys tracked is bounded.
+type lockout struct {
+	threshold int
+	baseDelay time.Duration
+	maxDelay  time.Duration
+
+	lock     sync.Mutex
+	failures *expirable.LRU[string, *failureRecord]
+}
+
+// failureRecord is what we know about a key's recent failures
+type failureRecord struct {
+	count       int
+	lockedUntil time.Time
+}
+
+// newLockout creates a lockout that locks a key after threshold failures.
+// The first lockout lasts baseDelay, doubling each further failure up to maxDelay.
+// A key's failures are forgotten once it hasn't failed for the reset period.
+func newLockout(size, threshold int, baseDelay, maxDelay, reset time.Duration) *lockout {
+	return &lockout{
+		threshold: threshold,
+		baseDelay: baseDelay,
+		maxDelay:  maxDelay,
+		failures:  expirable.NewLRU[string, *failureRecord](size, nil, reset),
+	}
+}
+
+// remaining returns how long the key is locked out for (zero if not locked out).
+func (l *lockout) remaining(key string, now time.Time) time.Duration {
+	if l.threshold <= 0 {
+		return 0
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	rec, ok := l.failures.Get(key)
+	if !ok || !now.Before(rec.lockedUntil) {
+		return 0
+	}
+	return rec.lockedUntil.Sub(now)
+}
+
+// fail records a failure for the key, returning the number of failures and how long
+// the key is now locked out for (zero if not locked out).
+func (l *lockout) fail(key string, now time.Time) (int, time.Duration) {
+	if l.threshold <= 0 {
+		return 0, 0
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	rec, ok := l.failures.Get(key)
+	if !ok {
+		rec = &failureRecord{}
+	}
+	rec.count++
+
+	var delay time.Duration
+	if rec.count >= l.threshold {
+		delay = l.baseDelay
+		for i := l.threshold; i < rec.count && delay < l.maxDelay; i++ {
+			delay *= 2
+		}
+		if delay > l.maxDelay {
+			delay = l.maxDelay
+		}
+		rec.lockedUntil = now.Add(delay)
+	}
+
+	l.failures.Add(key, rec) // (re)sets the expiry, so failures are forgotten after a quiet period
+	return rec.count, delay
+}
+
+// reset forgets all failures for the key.
+func (l *lockout) reset(key string) {
+	l.failures.Remove(key)
+}
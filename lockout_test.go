@@ -0,0 +1,43 @@
+package totp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockout(t *testing.T) {
+	l := newLockout(10, 3, time.Second, 4*time.Second, time.Hour)
+	now := time.Unix(1700000000, 0)
+
+	expect := []time.Duration{0, 0, time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second}
+	for i, delay := range expect {
+		count, wait := l.fail("mary", now)
+		assert.Equal(t, i+1, count)
+		assert.Equal(t, delay, wait)
+		assert.Equal(t, delay, l.remaining("mary", now))
+	}
+
+	// lockouts expire
+	assert.Equal(t, time.Duration(0), l.remaining("mary", now.Add(5*time.Second)))
+
+	// other keys are unaffected
+	assert.Equal(t, time.Duration(0), l.remaining("james", now))
+
+	// a reset forgets failures
+	l.reset("mary")
+	assert.Equal(t, time.Duration(0), l.remaining("mary", now))
+	count, wait := l.fail("mary", now)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, time.Duration(0), wait)
+}
+
+func TestLockoutDisabled(t *testing.T) {
+	l := newLockout(10, 0, time.Second, time.Second, time.Hour)
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		l.fail("mary", now)
+	}
+	assert.Equal(t, time.Duration(0), l.remaining("mary", now))
+}
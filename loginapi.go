@@ -0,0 +1,85 @@
+package totp
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// apiLoginRequest is the body of a JSON login.
+type apiLoginRequest struct {
+	User string `json:"user"`
+	Code string `json:"code"`
+}
+
+// apiLoginResponse is returned by a successful JSON login.
+type apiLoginResponse struct {
+	// Token is the session JWT, as would be set in the cookie
+	Token     string `json:"token"`
+	TokenType string `json:"token_type"`
+
+	// ExpiresAt is when the token expires (RFC 3339), ExpiresIn how many seconds that is from now
+	ExpiresAt string `json:"expires_at"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+// authAPILogin is the handler for the /auth/api/login endpoint, for CLI tools & SPAs.
+// POST {"user": .., "code": ..} checks the username & code (see checkLogin) with the same rate limiting,
+// lockouts & replay protection as the login form, and returns the session JWT as JSON.
+//
+// There's no CSRF token as there's no cookie; requiring a JSON body stops other sites
+// submitting logins from a user's browser.
+func (s *server) authAPILogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		log.Println("Method not allowed", r.Method)
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isJSONRequest(r) {
+		writeJSONError(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	req := &apiLoginRequest{}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(req)
+	if err != nil {
+		log.Println("Error parsing login:", err)
+		sendLoginFailureJSON(w, r, failureInvalidRequest, 0)
+		return
+	}
+
+	if !s.allowLogin(r, req.User) {
+		sendLoginFailureJSON(w, r, failureRateLimited, time.Duration(s.secondsBetweenLogins)*time.Second)
+		return
+	}
+
+	user, reason, wait := s.checkLogin(r, req.User, req.Code, false)
+	if reason != "" {
+		sendLoginFailureJSON(w, r, reason, wait)
+		return
+	}
+
+	_, span := tracer.Start(r.Context(), "login-success")
+	defer span.End()
+	span.AddEvent("Access approved")
+	span.SetAttributes(attribute.String("user", user.Username))
+
+	token, claims, err := newSessionJWT(s.jwtKeys.Active(), user, s.jwtSessionTTL)
+	if err != nil {
+		log.Println("Error generating JWT:", err)
+		sendLoginFailureJSON(w, r, failureInternal, 0)
+		return
+	}
+	log.Println("User logged in (API):", user.Username)
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, &apiLoginResponse{
+		Token:     token,
+		TokenType: "Bearer",
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0).UTC().Format(time.RFC3339),
+		ExpiresIn: int(claims.ExpiresAt - claims.IssuedAt),
+	}, http.StatusOK)
+}
@@ -0,0 +1,100 @@
+package totp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+// apiLogin POSTs a JSON login from the given client address.
+func apiLogin(h http.Handler, remoteAddr, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/auth/api/login", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestAPILogin(t *testing.T) {
+	s := newTestServer(t, WithSecondsBetweenLogins(0))
+	h := s.newHTTPHandler()
+
+	code, err := totp.GenerateCode("3UFC3DUK27KESHBWEJDQS4B2HXLHGFZV", time.Now())
+	assert.Nil(t, err)
+	w := apiLogin(h, "192.0.2.1:1234", `{"user": "mary", "code": "`+code+`"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Empty(t, w.Header().Get("Set-Cookie"))
+
+	resp := &apiLoginResponse{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), resp))
+	assert.Equal(t, "Bearer", resp.TokenType)
+	assert.Equal(t, 7200, resp.ExpiresIn)
+	expires, err := time.Parse(time.RFC3339, resp.ExpiresAt)
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), expires, 2*time.Second)
+
+	// the token is a session, usable as the cookie
+	claims, err := s.validateSession(resp.Token)
+	assert.Nil(t, err)
+	assert.Equal(t, "mary", claims.Username)
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/check", nil)
+	req.AddCookie(&http.Cookie{Name: s.cookieName, Value: resp.Token})
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// codes can't be replayed
+	w = apiLogin(h, "192.0.2.1:1234", `{"user": "mary", "code": "`+code+`"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, string(failureInvalidCode), w.Header().Get(loginFailureHeader))
+	assert.JSONEq(t, `{"error": "invalid_code", "message": "Invalid username or code"}`, w.Body.String())
+}
+
+func TestAPILoginFailures(t *testing.T) {
+	s := newTestServer(t, WithLockoutThreshold(2))
+	h := s.newHTTPHandler()
+
+	// not JSON
+	req := httptest.NewRequest(http.MethodPost, "/auth/api/login", strings.NewReader("user=mary&code=123456"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/auth/api/login", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = apiLogin(h, "192.0.2.1:1234", `{"user":`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, string(failureInvalidRequest), w.Header().Get(loginFailureHeader))
+
+	// the same lockouts & rate limit as the login form
+	w = apiLogin(h, "192.0.2.2:1234", `{"user": "mary", "code": "000000"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = apiLogin(h, "192.0.2.2:1234", `{"user": "mary", "code": "000000"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = apiLogin(h, "192.0.2.2:1234", `{"user": "mary", "code": "000000"}`)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, string(failureLockedOut), w.Header().Get(loginFailureHeader))
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), `"retry_after":`)
+	w = apiLogin(h, "192.0.2.2:1234", `{"user": "mary", "code": "000000"}`)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, string(failureRateLimited), w.Header().Get(loginFailureHeader))
+
+	// disabled
+	s = newTestServer(t, WithAuthAPILoginURL(""))
+	w = apiLogin(s.newHTTPHandler(), "192.0.2.1:1234", `{"user": "mary", "code": "000000"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -15,7 +15,8 @@ import (
 )
 
 var (
-	tracer trace.Tracer
+	// tracer defaults to the global (no-op) provider until setupOTelSDK is called
+	tracer trace.Tracer = otel.Tracer("github.com/voidshard/totp")
 )
 
 // setupOTelSDK bootstraps the OpenTelemetry pipeline.
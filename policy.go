@@ -0,0 +1,173 @@
+package totp
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// PolicyAnyUser in a rule's users allows any logged in user.
+const PolicyAnyUser = "*"
+
+// PolicyRule grants access to requests matching all of its (non empty) conditions.
+type PolicyRule struct {
+	// Path the request path must be, or be under, eg. /admin matches /admin & /admin/users but not /administrator
+	Path string `yaml:"path,omitempty"`
+
+	// PathRegex the request path must match, eg. ^/api/v[0-9]+/
+	PathRegex string `yaml:"path_regex,omitempty"`
+
+	// Hosts the request must be for (*.example.com for any subdomain), any if empty
+	Hosts []string `yaml:"hosts,omitempty"`
+
+	// Methods the request must use (GET, POST ..), any if empty
+	Methods []string `yaml:"methods,omitempty"`
+
+	// Users allowed access ("*" for anyone logged in)
+	Users []string `yaml:"users,omitempty"`
+
+	// Groups allowed access
+	Groups []string `yaml:"groups,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// Policy decides which users may access which paths. Rules are checked in order and the
+// first rule matching the request decides if the user is allowed; requests matching no rule are denied.
+type Policy struct {
+	rules []*PolicyRule
+}
+
+// policyRequest is the (original) request being authorized.
+type policyRequest struct {
+	Host   string
+	Method string
+	Path   string
+}
+
+// NewPolicy creates a Policy from the given rules.
+func NewPolicy(rules []*PolicyRule) (*Policy, error) {
+	for i, rule := range rules {
+		if rule.Path == "" && rule.PathRegex == "" {
+			return nil, fmt.Errorf("policy rule %d: path or path_regex is required", i+1)
+		}
+		if rule.Path != "" && !strings.HasPrefix(rule.Path, "/") {
+			return nil, fmt.Errorf("policy rule %d: path must start with /", i+1)
+		}
+		if len(rule.Users) == 0 && len(rule.Groups) == 0 {
+			return nil, fmt.Errorf("policy rule %d: users or groups is required", i+1)
+		}
+		if rule.PathRegex != "" {
+			re, err := regexp.Compile(rule.PathRegex)
+			if err != nil {
+				return nil, fmt.Errorf("policy rule %d: %w", i+1, err)
+			}
+			rule.re = re
+		}
+	}
+	return &Policy{rules: rules}, nil
+}
+
+// LoadPolicyFile reads a Policy from a YAML list of rules.
+func LoadPolicyFile(filename string) (*Policy, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	rules := []*PolicyRule{}
+	err = yaml.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, err
+	}
+	return NewPolicy(rules)
+}
+
+// Allowed returns if the user with the given claims may make the request.
+func (p *Policy) Allowed(req *policyRequest, claims *JWTClaim) bool {
+	for _, rule := range p.rules {
+		if rule.matches(req) {
+			return rule.allows(claims)
+		}
+	}
+	return false
+}
+
+// matches returns if the rule applies to the request.
+func (r *PolicyRule) matches(req *policyRequest) bool {
+	if r.Path != "" && !matchPath(r.Path, req.Path) {
+		return false
+	}
+	if r.re != nil && !r.re.MatchString(req.Path) {
+		return false
+	}
+	if len(r.Hosts) > 0 && !matchAnyHost(r.Hosts, req.Host) {
+		return false
+	}
+	if len(r.Methods) > 0 && !containsFold(r.Methods, req.Method) {
+		return false
+	}
+	return true
+}
+
+// allows returns if the rule grants access to the user.
+func (r *PolicyRule) allows(claims *JWTClaim) bool {
+	for _, u := range r.Users {
+		if u == PolicyAnyUser || u == claims.Username {
+			return true
+		}
+	}
+	for _, g := range r.Groups {
+		for _, cg := range claims.Groups {
+			if g == cg {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cleanRequestPath decodes & normalises a request URI (path and query) so that
+// eg. /public/../admin can't be used to get around a rule for /admin/.
+func cleanRequestPath(uri string) (string, error) {
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return "", err
+	}
+	p := path.Clean("/" + u.Path)
+	if strings.HasSuffix(u.Path, "/") && p != "/" {
+		p += "/"
+	}
+	return p, nil
+}
+
+// matchPath returns if the request path is the rule's path, or under it. Paths are compared
+// a segment at a time, with or without a trailing /, so /admin/ matches /admin but /admin doesn't match /administrator.
+func matchPath(rulePath, requestPath string) bool {
+	rulePath = strings.TrimSuffix(rulePath, "/")
+	return rulePath == "" || requestPath == rulePath || strings.HasPrefix(requestPath, rulePath+"/")
+}
+
+// matchAnyHost returns if the host matches any of the patterns (see matchHost).
+func matchAnyHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsFold returns if the list contains s, ignoring case.
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
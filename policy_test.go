@@ -0,0 +1,96 @@
+package totp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicy(t *testing.T) {
+	policy, err := NewPolicy([]*PolicyRule{
+		{Path: "/admin/", Users: []string{"mary"}, Groups: []string{"admin"}},
+		{PathRegex: `^/api/v[0-9]+/`, Hosts: []string{"api.example.com"}, Methods: []string{"GET"}, Users: []string{PolicyAnyUser}},
+		{Path: "/public/", Users: []string{PolicyAnyUser}},
+		{Path: "/team", Hosts: []string{"*.internal.example.com"}, Groups: []string{"dev"}},
+	})
+	assert.Nil(t, err)
+
+	mary := &JWTClaim{Username: "mary"}
+	james := &JWTClaim{Username: "james"}
+	admin := &JWTClaim{Username: "test", Groups: []string{"dev", "admin"}}
+
+	cases := []struct {
+		name    string
+		req     *policyRequest
+		claims  *JWTClaim
+		allowed bool
+	}{
+		{"user allowed", &policyRequest{Path: "/admin/users"}, mary, true},
+		{"group allowed", &policyRequest{Path: "/admin/users"}, admin, true},
+		{"user not allowed", &policyRequest{Path: "/admin/users"}, james, false},
+		{"any user", &policyRequest{Path: "/public/x"}, james, true},
+		{"regex, host & method", &policyRequest{Host: "API.example.com", Method: "get", Path: "/api/v2/x"}, james, true},
+		{"wrong host", &policyRequest{Host: "example.com", Method: "GET", Path: "/api/v2/x"}, james, false},
+		{"wrong method", &policyRequest{Host: "api.example.com", Method: "POST", Path: "/api/v2/x"}, james, false},
+		{"no rule", &policyRequest{Path: "/other"}, mary, false},
+		{"path without trailing slash", &policyRequest{Path: "/admin"}, mary, true},
+		{"path segment", &policyRequest{Host: "wiki.internal.example.com", Path: "/team/x"}, admin, true},
+		{"path exactly", &policyRequest{Host: "wiki.internal.example.com", Path: "/team"}, admin, true},
+		{"path prefix of a segment", &policyRequest{Host: "wiki.internal.example.com", Path: "/teams"}, admin, false},
+		{"wildcard host", &policyRequest{Host: "Wiki.Internal.example.com", Path: "/team/x"}, admin, true},
+		{"wildcard host's parent", &policyRequest{Host: "internal.example.com", Path: "/team/x"}, admin, false},
+		{"wildcard host elsewhere", &policyRequest{Host: "wiki.example.com", Path: "/team/x"}, admin, false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.allowed, policy.Allowed(c.req, c.claims), c.name)
+	}
+}
+
+func TestNewPolicyInvalid(t *testing.T) {
+	for _, rule := range []*PolicyRule{
+		{Users: []string{"mary"}},
+		{Path: "admin", Users: []string{"mary"}},
+		{Path: "/admin/"},
+		{PathRegex: "(", Users: []string{"mary"}},
+	} {
+		_, err := NewPolicy([]*PolicyRule{rule})
+		assert.NotNil(t, err)
+	}
+}
+
+func TestLoadPolicyFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "policy.yaml")
+	err := os.WriteFile(filename, []byte(`
+- path: /admin/
+  groups: [admin]
+- path_regex: ^/
+  users: ["*"]
+`), 0600)
+	assert.Nil(t, err)
+
+	policy, err := LoadPolicyFile(filename)
+	assert.Nil(t, err)
+	assert.False(t, policy.Allowed(&policyRequest{Path: "/admin/"}, &JWTClaim{Username: "mary"}))
+	assert.True(t, policy.Allowed(&policyRequest{Path: "/home"}, &JWTClaim{Username: "mary"}))
+}
+
+func TestCleanRequestPath(t *testing.T) {
+	cases := map[string]string{
+		"/":                      "/",
+		"/admin/":                "/admin/",
+		"/admin?x=1":             "/admin",
+		"/public/../admin/users": "/admin/users",
+		"/public/%2e%2e/admin/":  "/admin/",
+		"//admin//x":             "/admin/x",
+	}
+	for uri, expect := range cases {
+		p, err := cleanRequestPath(uri)
+		assert.Nil(t, err, uri)
+		assert.Equal(t, expect, p, uri)
+	}
+
+	_, err := cleanRequestPath("not a path")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,93 @@
+package totp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// RateLimitKey is what login attempts are rate limited by
+type RateLimitKey string
+
+const (
+	// RateLimitByIP gives each client IP its own limit
+	RateLimitByIP RateLimitKey = "ip"
+
+	// RateLimitByUser gives each username its own limit
+	RateLimitByUser RateLimitKey = "user"
+
+	// RateLimitByIPAndUser requires an attempt to be within both the client IP's and the username's limit
+	RateLimitByIPAndUser RateLimitKey = "both"
+)
+
+// validate checks the key is one we know about
+func (k RateLimitKey) validate() error {
+	switch k {
+	case RateLimitByIP, RateLimitByUser, RateLimitByIPAndUser:
+		return nil
+	}
+	return fmt.Errorf("unknown rate limit key %q", k)
+}
+
+// rateLimiter is a keyed token bucket rate limiter, safe for concurrent use.
+// Each key's bucket holds up to burst tokens and refills one token every interval.
+// The number of buckets is bounded; a key whose bucket is evicted simply starts again with a full bucket.
+type rateLimiter struct {
+	interval time.Duration
+	burst    float64
+
+	lock    sync.Mutex
+	buckets *lru.Cache[string, *bucket]
+}
+
+// bucket is the state of a single key's token bucket
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter creates a rate limiter tracking up to size keys.
+// An interval of zero or less disables rate limiting.
+func newRateLimiter(size int, interval time.Duration, burst int) (*rateLimiter, error) {
+	if burst < 1 {
+		burst = 1
+	}
+	buckets, err := lru.New[string, *bucket](size)
+	if err != nil {
+		return nil, err
+	}
+	return &rateLimiter{interval: interval, burst: float64(burst), buckets: buckets}, nil
+}
+
+// allow takes a token from the key's bucket, returning false if there are none left.
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	if l.interval <= 0 {
+		return true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	b, ok := l.buckets.Get(key)
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets.Add(key, b)
+	}
+
+	// refill for the time since we last saw this key
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += float64(elapsed) / float64(l.interval)
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,76 @@
+package totp
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l, err := newRateLimiter(10, time.Second, 2)
+	assert.Nil(t, err)
+	now := time.Unix(1700000000, 0)
+
+	// burst, then nothing
+	assert.True(t, l.allow("a", now))
+	assert.True(t, l.allow("a", now))
+	assert.False(t, l.allow("a", now))
+
+	// other keys have their own bucket
+	assert.True(t, l.allow("b", now))
+
+	// refills over time, but never beyond the burst
+	assert.False(t, l.allow("a", now.Add(500*time.Millisecond)))
+	assert.True(t, l.allow("a", now.Add(time.Second)))
+	assert.False(t, l.allow("a", now.Add(time.Second)))
+	assert.True(t, l.allow("a", now.Add(time.Hour)))
+	assert.True(t, l.allow("a", now.Add(time.Hour)))
+	assert.False(t, l.allow("a", now.Add(time.Hour)))
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	l, err := newRateLimiter(10, 0, 1)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		assert.True(t, l.allow("a", time.Now()))
+	}
+}
+
+func TestRateLimiterBounded(t *testing.T) {
+	l, err := newRateLimiter(5, time.Second, 1)
+	assert.Nil(t, err)
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		l.allow(fmt.Sprintf("key-%d", i), now)
+	}
+	assert.Equal(t, 5, l.buckets.Len())
+}
+
+func TestRateLimiterConcurrent(t *testing.T) {
+	// run with -race
+	l, err := newRateLimiter(100, time.Hour, 10)
+	assert.Nil(t, err)
+	now := time.Now()
+
+	var allowed int64
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if l.allow(fmt.Sprintf("key-%d", j%4), now) {
+					atomic.AddInt64(&allowed, 1)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// each of the 4 keys gets exactly its burst
+	assert.Equal(t, int64(40), allowed)
+}
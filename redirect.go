@@ -0,0 +1,96 @@
+package totp
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// returnURL works out where the user was trying to go before being sent to log in. In order of preference
+//   - an "rd" query parameter (eg. nginx: return 302 /auth/login?rd=$request_uri)
+//   - X-Forwarded-Proto, X-Forwarded-Host & X-Forwarded-Uri (eg. Traefik forward auth)
+//   - X-Original-URI (eg. nginx proxying the login page with proxy_set_header X-Original-URI $request_uri)
+//
+// Returns "" if there is none, or it isn't allowed (see allowedReturnURL).
+func returnURL(r *http.Request, allow []string) string {
+	raw := r.URL.Query().Get("rd")
+	if raw == "" {
+		raw = r.Header.Get("X-Forwarded-Uri")
+		if raw == "" {
+			raw = r.Header.Get("X-Original-URI")
+		}
+		if host := r.Header.Get("X-Forwarded-Host"); raw != "" && host != "" {
+			proto := r.Header.Get("X-Forwarded-Proto")
+			if proto == "" {
+				proto = "https"
+			}
+			raw = proto + "://" + host + raw
+		}
+	}
+	if raw == "" {
+		return ""
+	}
+	u, ok := allowedReturnURL(raw, allow)
+	if !ok {
+		return ""
+	}
+	return u
+}
+
+// allowedReturnURL checks a URL is somewhere we're willing to redirect to after login, so the
+// login page can't be used as an open redirect. Returns the URL to redirect to if so.
+//
+// Entries in the allow list are either
+//   - a path prefix, eg. /app/ allowing relative URLs under it
+//   - a host with an optional path prefix, eg. app.example.com or *.example.com/app/
+//
+// With an empty allow list only relative URLs (on the same host as us) are allowed.
+func allowedReturnURL(raw string, allow []string) (string, bool) {
+	// browsers treat \ like /, so /\evil.com would be a protocol relative URL
+	if strings.ContainsAny(raw, "\\\r\n\t") {
+		return "", false
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.User != nil || u.Opaque != "" {
+		return "", false
+	}
+
+	relative := u.Scheme == "" && u.Host == ""
+	if !relative && (u.Host == "" || (u.Scheme != "https" && u.Scheme != "http")) {
+		return "", false
+	}
+	if relative && (!strings.HasPrefix(raw, "/") || strings.HasPrefix(raw, "//")) {
+		return "", false
+	}
+
+	p, err := cleanRequestPath("/" + strings.TrimPrefix(u.EscapedPath(), "/"))
+	if err != nil {
+		return "", false
+	}
+
+	if len(allow) == 0 {
+		return u.String(), relative
+	}
+	for _, entry := range allow {
+		host, prefix := "", entry
+		if !strings.HasPrefix(entry, "/") {
+			host, prefix, _ = strings.Cut(entry, "/")
+			prefix = "/" + prefix
+		}
+		if host == "" && !relative || host != "" && (relative || !matchHost(host, u.Hostname())) {
+			continue
+		}
+		if strings.HasPrefix(p, prefix) {
+			return u.String(), true
+		}
+	}
+	return "", false
+}
+
+// matchHost returns if the host matches the pattern, which may start with *. to match any subdomain.
+func matchHost(pattern, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(strings.ToLower(host), "."+strings.ToLower(suffix))
+	}
+	return strings.EqualFold(pattern, host)
+}
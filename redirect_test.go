@@ -0,0 +1,72 @@
+package totp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllowedReturnURL(t *testing.T) {
+	cases := []struct {
+		raw     string
+		allow   []string
+		allowed bool
+	}{
+		// relative URLs are allowed by default
+		{"/app/x?y=1", nil, true},
+		{"https://example.com/", nil, false},
+
+		// but never protocol relative ones, or other schemes
+		{"//evil.com/", nil, false},
+		{"/\\evil.com/", nil, false},
+		{"javascript:alert(1)", []string{"/"}, false},
+		{"app/x", nil, false},
+		{"https://user@example.com/", []string{"example.com"}, false},
+
+		// hosts
+		{"https://example.com/x", []string{"example.com"}, true},
+		{"https://EXAMPLE.com:8443/x", []string{"example.com"}, true},
+		{"https://example.com.evil.com/", []string{"example.com"}, false},
+		{"https://app.example.com/", []string{"*.example.com"}, true},
+		{"https://example.com/", []string{"*.example.com"}, false},
+		{"https://evilexample.com/", []string{"*.example.com"}, false},
+		{"ftp://example.com/", []string{"example.com"}, false},
+
+		// path prefixes
+		{"https://example.com/app/x", []string{"example.com/app/"}, true},
+		{"https://example.com/other", []string{"example.com/app/"}, false},
+		{"https://example.com/app/../other", []string{"example.com/app/"}, false},
+		{"/app/x", []string{"/app/"}, true},
+		{"/other", []string{"/app/"}, false},
+		{"/app/x", []string{"example.com"}, false},
+	}
+	for _, c := range cases {
+		_, ok := allowedReturnURL(c.raw, c.allow)
+		assert.Equal(t, c.allowed, ok, c.raw)
+	}
+}
+
+func TestReturnURL(t *testing.T) {
+	allow := []string{"app.example.com"}
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/login?rd=https%3A%2F%2Fapp.example.com%2Fx", nil)
+	assert.Equal(t, "https://app.example.com/x", returnURL(req, allow))
+
+	req = httptest.NewRequest(http.MethodGet, "/auth/login?rd=https%3A%2F%2Fevil.com%2F", nil)
+	assert.Equal(t, "", returnURL(req, allow))
+
+	req = httptest.NewRequest(http.MethodGet, "/auth/login", nil)
+	req.Header.Set("X-Forwarded-Proto", "http")
+	req.Header.Set("X-Forwarded-Host", "app.example.com")
+	req.Header.Set("X-Forwarded-Uri", "/y")
+	assert.Equal(t, "http://app.example.com/y", returnURL(req, allow))
+
+	req = httptest.NewRequest(http.MethodGet, "/auth/login", nil)
+	req.Header.Set("X-Original-URI", "/z")
+	assert.Equal(t, "/z", returnURL(req, nil))
+
+	req = httptest.NewRequest(http.MethodGet, "/auth/login", nil)
+	assert.Equal(t, "", returnURL(req, nil))
+}
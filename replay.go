@@ -0,0 +1,44 @@
+package totp
+
+import (
+	"sync"
+)
+
+// ReplayStore remembers the last TOTP time step accepted for each user, so that a code
+// can't be used twice (nor can any code older than the last one used).
+// Steps are given as the unix time the step started, so they're comparable even if a
+// user's TOTP period changes.
+//
+// The default store is in memory, which is fine for a single server. When running several
+// replicas they should share a store (eg. SQLite), otherwise a code used against one
+// replica can be replayed against another.
+type ReplayStore interface {
+	// Accept records that the user has used the given time step, returning false if the
+	// step is not newer than the last step accepted for them.
+	Accept(username string, step uint64) (bool, error)
+}
+
+// memoryReplayStore is an in memory ReplayStore.
+// We only record users that have presented a valid code, so this is bounded by the number of users.
+type memoryReplayStore struct {
+	lock  sync.Mutex
+	steps map[string]uint64
+}
+
+// NewMemoryReplayStore creates a new in memory ReplayStore.
+func NewMemoryReplayStore() ReplayStore {
+	return &memoryReplayStore{steps: map[string]uint64{}}
+}
+
+// Accept records the step for the user if it is newer than their last.
+func (m *memoryReplayStore) Accept(username string, step uint64) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	last, ok := m.steps[username]
+	if ok && step <= last {
+		return false, nil
+	}
+	m.steps[username] = step
+	return true, nil
+}
@@ -0,0 +1,76 @@
+package totp
+
+import (
+	"sync"
+	"time"
+)
+
+// RevocationStore records sessions that have been ended before their JWT expired, eg. by logging out.
+// It is checked every time a session is validated.
+//
+// As with the ReplayStore, the default is in memory; replicas should share a store (eg. SQLite),
+// otherwise a session revoked on one replica is still valid on the others.
+type RevocationStore interface {
+	// Revoke revokes a single session by its JWT ID. The revocation only needs to be remembered
+	// until expires, after which the JWT is invalid anyway.
+	Revoke(id string, expires time.Time) error
+
+	// RevokeUser revokes every session of the user issued before the given time. Times are whole seconds, like
+	// JWT issue times, so sessions issued in the same second (eg. logging in again straight away) aren't revoked.
+	RevokeUser(username string, before time.Time) error
+
+	// Revoked returns if the session with the given claims has been revoked.
+	Revoked(claims *JWTClaim) (bool, error)
+}
+
+// memoryRevocationStore is an in memory RevocationStore.
+type memoryRevocationStore struct {
+	lock  sync.RWMutex
+	ids   map[string]time.Time // jti -> when the token expires
+	users map[string]time.Time // username -> tokens issued before this are revoked
+}
+
+// NewMemoryRevocationStore creates a new in memory RevocationStore.
+func NewMemoryRevocationStore() RevocationStore {
+	return &memoryRevocationStore{ids: map[string]time.Time{}, users: map[string]time.Time{}}
+}
+
+// Revoke revokes a session by ID until it expires.
+func (m *memoryRevocationStore) Revoke(id string, expires time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// forget revocations of tokens that have since expired, so we don't grow forever
+	now := time.Now()
+	for k, exp := range m.ids {
+		if exp.Before(now) {
+			delete(m.ids, k)
+		}
+	}
+
+	m.ids[id] = expires
+	return nil
+}
+
+// RevokeUser revokes all of a user's sessions issued before the given time (see RevocationStore).
+func (m *memoryRevocationStore) RevokeUser(username string, before time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if before.After(m.users[username]) {
+		m.users[username] = before
+	}
+	return nil
+}
+
+// Revoked returns if the session has been revoked.
+func (m *memoryRevocationStore) Revoked(claims *JWTClaim) (bool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if _, ok := m.ids[claims.Id]; ok && claims.Id != "" {
+		return true, nil
+	}
+	before, ok := m.users[claims.Username]
+	return ok && claims.IssuedAt < before.Unix(), nil
+}
@@ -0,0 +1,73 @@
+package totp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevocationStores(t *testing.T) {
+	stores := map[string]RevocationStore{
+		"memory": NewMemoryRevocationStore(),
+		"sqlite": newTestSQLite(t),
+	}
+
+	now := time.Now()
+	claims := func(id, username string, issued time.Time) *JWTClaim {
+		c := &JWTClaim{Username: username}
+		c.Id = id
+		c.IssuedAt = issued.Unix()
+		return c
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			revoked, err := store.Revoked(claims("a", "mary", now))
+			assert.Nil(t, err)
+			assert.False(t, revoked)
+
+			// revoking by ID only affects that session
+			assert.Nil(t, store.Revoke("a", now.Add(time.Hour)))
+			revoked, err = store.Revoked(claims("a", "mary", now))
+			assert.Nil(t, err)
+			assert.True(t, revoked)
+			revoked, err = store.Revoked(claims("b", "mary", now))
+			assert.Nil(t, err)
+			assert.False(t, revoked)
+
+			// revoking a user affects sessions issued up to then
+			assert.Nil(t, store.RevokeUser("james", now))
+			revoked, err = store.Revoked(claims("c", "james", now.Add(-time.Minute)))
+			assert.Nil(t, err)
+			assert.True(t, revoked)
+			revoked, err = store.Revoked(claims("d", "james", now.Add(time.Minute)))
+			assert.Nil(t, err)
+			assert.False(t, revoked)
+
+			// .. but not ones issued in the same second, eg. logging in again straight away
+			revoked, err = store.Revoked(claims("e", "james", now))
+			assert.Nil(t, err)
+			assert.False(t, revoked)
+
+			// an earlier time doesn't un-revoke anything
+			assert.Nil(t, store.RevokeUser("james", now.Add(-time.Hour)))
+			revoked, err = store.Revoked(claims("c", "james", now.Add(-time.Minute)))
+			assert.Nil(t, err)
+			assert.True(t, revoked)
+		})
+	}
+}
+
+// earlierSessionJWT signs a session for the user issued a minute ago, as revoking a user only revokes
+// sessions issued before the second they're revoked in.
+func earlierSessionJWT(t *testing.T, key *JWTKey, username string) string {
+	claims := &JWTClaim{Username: username}
+	claims.Id = "earlier"
+	claims.IssuedAt = time.Now().Add(-time.Minute).Unix()
+	claims.ExpiresAt = time.Now().Add(time.Hour).Unix()
+	token, err := jwt.NewWithClaims(key.method, claims).SignedString(key.signKey)
+	assert.Nil(t, err)
+	return token
+}
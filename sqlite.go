@@ -0,0 +1,472 @@
+package totp
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	_ "modernc.org/sqlite" // pure go, so we can still build with CGO_ENABLED=0
+)
+
+// migrations are applied in order to bring the database schema up to date.
+// The index+1 of a migration is its schema version; never edit or reorder
+// existing entries, only append new ones.
+var migrations = []string{
+	// 1: initial schema
+	`CREATE TABLE metadata (
+		key   TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);
+	CREATE TABLE users (
+		username   TEXT PRIMARY KEY,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	);
+	CREATE TABLE secrets (
+		username TEXT PRIMARY KEY REFERENCES users(username) ON DELETE CASCADE,
+		secret   TEXT NOT NULL
+	);`,
+	// 2: last accepted TOTP step per user (see ReplayStore), not tied to the users table
+	// so it can be shared even if users are stored elsewhere
+	`CREATE TABLE totp_steps (
+		username TEXT PRIMARY KEY,
+		step     INTEGER NOT NULL
+	);`,
+	// 3: hashed one-time backup codes
+	`CREATE TABLE backup_codes (
+		username TEXT NOT NULL REFERENCES users(username) ON DELETE CASCADE,
+		hash     TEXT NOT NULL,
+		PRIMARY KEY (username, hash)
+	);`,
+	// 4: per user TOTP parameters (see TOTPOptions), zero values are the defaults
+	`ALTER TABLE secrets ADD COLUMN digits INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE secrets ADD COLUMN period INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE secrets ADD COLUMN algorithm TEXT NOT NULL DEFAULT '';
+	ALTER TABLE secrets ADD COLUMN skew INTEGER NOT NULL DEFAULT 0;`,
+	// 5: revoked sessions (see RevocationStore)
+	`CREATE TABLE revoked_tokens (
+		id         TEXT PRIMARY KEY,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE TABLE revoked_users (
+		username TEXT PRIMARY KEY,
+		before   INTEGER NOT NULL
+	);`,
+	// 6: user details, groups & free-form attributes
+	`ALTER TABLE users ADD COLUMN display_name TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN email TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN disabled INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE user_groups (
+		username TEXT NOT NULL REFERENCES users(username) ON DELETE CASCADE,
+		name     TEXT NOT NULL,
+		PRIMARY KEY (username, name)
+	);
+	CREATE TABLE user_attributes (
+		username TEXT NOT NULL REFERENCES users(username) ON DELETE CASCADE,
+		key      TEXT NOT NULL,
+		value    TEXT NOT NULL,
+		PRIMARY KEY (username, key)
+	);`,
+	// 7: bcrypt password hashes, for HTTP Basic auth (see BasicAuthMode)
+	`ALTER TABLE secrets ADD COLUMN password_hash TEXT NOT NULL DEFAULT '';`,
+}
+
+// SQLite is a storage backend that keeps users in a SQLite database.
+type SQLite struct {
+	db     *sql.DB
+	cipher *secretCipher
+}
+
+// NewSQLite opens (creating if needed) a SQLite database at the given path
+// and migrates it to the latest schema.
+func NewSQLite(path string, opts ...StorageOption) (*SQLite, error) {
+	c, err := newStorageCipher(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// escape the path, so eg. a ? in it doesn't start the query
+	dsn := &url.URL{
+		Scheme:   "file",
+		Path:     path,
+		OmitHost: true,
+		RawQuery: "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)",
+	}
+	db, err := sql.Open("sqlite", dsn.String())
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SQLite{db: db, cipher: c}
+	err = s.migrate()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the underlying database.
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
+
+// SchemaVersion returns the current schema version of the database.
+func (s *SQLite) SchemaVersion() (int, error) {
+	return schemaVersion(s.db)
+}
+
+// migrate applies any migrations that haven't yet been run.
+func (s *SQLite) migrate() error {
+	current, err := schemaVersion(s.db)
+	if err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than supported version %d", current, len(migrations))
+	}
+
+	for i := current; i < len(migrations); i++ {
+		err = s.inTx(func(tx *sql.Tx) error {
+			_, err := tx.Exec(migrations[i])
+			if err != nil {
+				return fmt.Errorf("failed to apply migration %d: %w", i+1, err)
+			}
+			_, err = tx.Exec(
+				`INSERT INTO metadata (key, value) VALUES ('schema_version', ?)
+				ON CONFLICT (key) DO UPDATE SET value = excluded.value`,
+				strconv.Itoa(i+1),
+			)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaVersion reads the schema version, returning 0 for a new database.
+func schemaVersion(db *sql.DB) (int, error) {
+	var exists int
+	err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'metadata'`).Scan(&exists)
+	if err != nil || exists == 0 {
+		return 0, err
+	}
+
+	var value string
+	err = db.QueryRow(`SELECT value FROM metadata WHERE key = 'schema_version'`).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// User returns a User object by username.
+func (s *SQLite) User(username string) (*User, error) {
+	users, err := s.queryUsers(`WHERE u.username = ?`, username)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, ErrUserNotFound
+	}
+	return users[0], nil
+}
+
+// Users returns all users, sorted by username.
+func (s *SQLite) Users() ([]*User, error) {
+	return s.queryUsers(``)
+}
+
+// CreateUser adds a new user.
+func (s *SQLite) CreateUser(user *User) error {
+	if err := user.validate(); err != nil {
+		return err
+	}
+	return s.inTx(func(tx *sql.Tx) error {
+		now := time.Now().Unix()
+		res, err := tx.Exec(
+			`INSERT INTO users (username, created_at, updated_at, display_name, email, disabled) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT DO NOTHING`,
+			user.Username, now, now, user.DisplayName, user.Email, user.Disabled,
+		)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrUserExists
+		}
+		return s.writeUserRows(tx, user)
+	})
+}
+
+// UpdateUser replaces an existing user.
+func (s *SQLite) UpdateUser(user *User) error {
+	if err := user.validate(); err != nil {
+		return err
+	}
+	return s.inTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec(
+			`UPDATE users SET updated_at = ?, display_name = ?, email = ?, disabled = ? WHERE username = ?`,
+			time.Now().Unix(), user.DisplayName, user.Email, user.Disabled, user.Username,
+		)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrUserNotFound
+		}
+		return s.writeUserRows(tx, user)
+	})
+}
+
+// DeleteUser removes a user, and (via cascade) their secret.
+func (s *SQLite) DeleteUser(username string) error {
+	res, err := s.db.Exec(`DELETE FROM users WHERE username = ?`, username)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// UseBackupCode removes a user's backup code by hash (see BackupCodeStorage).
+// This is a single delete, so only one of any replicas sharing the database using the code succeeds.
+func (s *SQLite) UseBackupCode(username, hash string) (bool, error) {
+	res, err := s.db.Exec(`DELETE FROM backup_codes WHERE username = ? AND hash = ?`, username, hash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Accept records the TOTP step for the user if it is newer than their last (see ReplayStore).
+// This is a single conditional upsert, so it is safe for replicas sharing the database.
+func (s *SQLite) Accept(username string, step uint64) (bool, error) {
+	res, err := s.db.Exec(
+		`INSERT INTO totp_steps (username, step) VALUES (?, ?)
+		ON CONFLICT (username) DO UPDATE SET step = excluded.step WHERE excluded.step > totp_steps.step`,
+		username, int64(step),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Revoke revokes a session by JWT ID until it expires (see RevocationStore).
+func (s *SQLite) Revoke(id string, expires time.Time) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		// forget revocations of tokens that have since expired, so we don't grow forever
+		_, err := tx.Exec(`DELETE FROM revoked_tokens WHERE expires_at < ?`, time.Now().Unix())
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			`INSERT INTO revoked_tokens (id, expires_at) VALUES (?, ?) ON CONFLICT DO NOTHING`,
+			id, expires.Unix(),
+		)
+		return err
+	})
+}
+
+// RevokeUser revokes all of a user's sessions issued before the given time (see RevocationStore).
+func (s *SQLite) RevokeUser(username string, before time.Time) error {
+	_, err := s.db.Exec(
+		`INSERT INTO revoked_users (username, before) VALUES (?, ?)
+		ON CONFLICT (username) DO UPDATE SET before = excluded.before WHERE excluded.before > revoked_users.before`,
+		username, before.Unix(),
+	)
+	return err
+}
+
+// Revoked returns if the session has been revoked (see RevocationStore).
+func (s *SQLite) Revoked(claims *JWTClaim) (bool, error) {
+	var revoked bool
+	err := s.db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE id = ? AND id != '')
+		OR EXISTS (SELECT 1 FROM revoked_users WHERE username = ? AND before > ?)`,
+		claims.Id, claims.Username, claims.IssuedAt,
+	).Scan(&revoked)
+	return revoked, err
+}
+
+// writeUserRows writes everything we hold about a user, other than the users row itself.
+func (s *SQLite) writeUserRows(tx *sql.Tx, user *User) error {
+	secret, err := encryptSecret(s.cipher, user.Username, user.Secret)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO secrets (username, secret, digits, period, algorithm, skew, password_hash) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (username) DO UPDATE SET
+			secret = excluded.secret,
+			digits = excluded.digits,
+			period = excluded.period,
+			algorithm = excluded.algorithm,
+			skew = excluded.skew,
+			password_hash = excluded.password_hash`,
+		user.Username, secret, user.Digits, user.Period, user.Algorithm, user.Skew, user.PasswordHash,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM backup_codes WHERE username = ?`, user.Username)
+	if err != nil {
+		return err
+	}
+	for _, hash := range user.BackupCodes {
+		_, err = tx.Exec(`INSERT INTO backup_codes (username, hash) VALUES (?, ?)`, user.Username, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`DELETE FROM user_groups WHERE username = ?`, user.Username)
+	if err != nil {
+		return err
+	}
+	for _, group := range user.Groups {
+		_, err = tx.Exec(`INSERT INTO user_groups (username, name) VALUES (?, ?) ON CONFLICT DO NOTHING`, user.Username, group)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`DELETE FROM user_attributes WHERE username = ?`, user.Username)
+	if err != nil {
+		return err
+	}
+	for key, value := range user.Attributes {
+		_, err = tx.Exec(`INSERT INTO user_attributes (username, key, value) VALUES (?, ?, ?)`, user.Username, key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryUsers loads users matching the given WHERE clause (which may be empty).
+func (s *SQLite) queryUsers(where string, args ...interface{}) ([]*User, error) {
+	rows, err := s.db.Query(
+		`SELECT u.username, u.display_name, u.email, u.disabled, s.secret, s.digits, s.period, s.algorithm, s.skew, s.password_hash
+		FROM users u JOIN secrets s ON s.username = u.username
+		`+where+`
+		ORDER BY u.username`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	byName := map[string]*User{}
+	for rows.Next() {
+		u := &User{}
+		err = rows.Scan(&u.Username, &u.DisplayName, &u.Email, &u.Disabled, &u.Secret, &u.Digits, &u.Period, &u.Algorithm, &u.Skew, &u.PasswordHash)
+		if err != nil {
+			return nil, err
+		}
+		u.Secret, err = decryptSecret(s.cipher, u.Username, u.Secret)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+		byName[u.Username] = u
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// attach backup codes & groups
+	err = s.queryUserRows(
+		`SELECT u.username, b.hash, ''
+		FROM users u JOIN backup_codes b ON b.username = u.username
+		`+where+`
+		ORDER BY u.username, b.rowid`,
+		args,
+		func(u *User, hash, _ string) { u.BackupCodes = append(u.BackupCodes, hash) },
+		byName,
+	)
+	if err != nil {
+		return nil, err
+	}
+	err = s.queryUserRows(
+		`SELECT u.username, g.name, ''
+		FROM users u JOIN user_groups g ON g.username = u.username
+		`+where+`
+		ORDER BY u.username, g.rowid`,
+		args,
+		func(u *User, group, _ string) { u.Groups = append(u.Groups, group) },
+		byName,
+	)
+	if err != nil {
+		return nil, err
+	}
+	err = s.queryUserRows(
+		`SELECT u.username, a.key, a.value
+		FROM users u JOIN user_attributes a ON a.username = u.username
+		`+where,
+		args,
+		func(u *User, key, value string) {
+			if u.Attributes == nil {
+				u.Attributes = map[string]string{}
+			}
+			u.Attributes[key] = value
+		},
+		byName,
+	)
+	return users, err
+}
+
+// queryUserRows runs a query returning (username, a, b) rows, calling fn for each row of a user we know about.
+func (s *SQLite) queryUserRows(query string, args []interface{}, fn func(u *User, a, b string), byName map[string]*User) error {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var username, a, b string
+		err = rows.Scan(&username, &a, &b)
+		if err != nil {
+			return err
+		}
+		if u, ok := byName[username]; ok {
+			fn(u, a, b)
+		}
+	}
+	return rows.Err()
+}
+
+// inTx runs fn in a transaction, committing if it returns nil.
+func (s *SQLite) inTx(fn func(*sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,187 @@
+package totp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSQLite(t *testing.T) *SQLite {
+	store, err := NewSQLite(filepath.Join(t.TempDir(), "users.db"))
+	assert.Nil(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+
+	store, err := NewSQLite(path)
+	assert.Nil(t, err)
+	version, err := store.SchemaVersion()
+	assert.Nil(t, err)
+	assert.Equal(t, len(migrations), version)
+	assert.Nil(t, store.CreateUser(&User{Username: "mary", Secret: "3UFC3DUK27KESHBWEJDQS4B2HXLHGFZV"}))
+	assert.Nil(t, store.Close())
+
+	// re-opening doesn't re-apply migrations or lose data
+	store, err = NewSQLite(path)
+	assert.Nil(t, err)
+	defer store.Close()
+	u, err := store.User("mary")
+	assert.Nil(t, err)
+	assert.Equal(t, "3UFC3DUK27KESHBWEJDQS4B2HXLHGFZV", u.Secret)
+}
+
+func TestSQLitePath(t *testing.T) {
+	for _, name := range []string{"users.db", "a?b#c%d.db", "a b&c.db"} {
+		path := filepath.Join(t.TempDir(), name)
+		store, err := NewSQLite(path)
+		if !assert.Nil(t, err, name) {
+			continue
+		}
+		assert.Nil(t, store.CreateUser(&User{Username: "mary", Secret: "3UFC3DUK27KESHBWEJDQS4B2HXLHGFZV"}))
+		store.Close()
+		assert.FileExists(t, path)
+	}
+
+	// relative paths too
+	wd, err := os.Getwd()
+	assert.Nil(t, err)
+	assert.Nil(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(wd)
+	store, err := NewSQLite("users.db")
+	assert.Nil(t, err)
+	store.Close()
+	assert.FileExists(t, "users.db")
+}
+
+func TestSQLiteUseBackupCode(t *testing.T) {
+	// two replicas sharing the database
+	path := filepath.Join(t.TempDir(), "users.db")
+	a, err := NewSQLite(path)
+	assert.Nil(t, err)
+	defer a.Close()
+	b, err := NewSQLite(path)
+	assert.Nil(t, err)
+	defer b.Close()
+
+	assert.Nil(t, a.CreateUser(&User{Username: "mary", Secret: "3UFC3DUK27KESHBWEJDQS4B2HXLHGFZV", BackupCodes: []string{"sha256:01:aa", "sha256:02:bb"}}))
+
+	ok, err := a.UseBackupCode("mary", "sha256:01:aa")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = b.UseBackupCode("mary", "sha256:01:aa")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = b.UseBackupCode("james", "sha256:02:bb")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	u, err := b.User("mary")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sha256:02:bb"}, u.BackupCodes)
+}
+
+func TestSQLite(t *testing.T) {
+	store := newTestSQLite(t)
+
+	// create
+	assert.Nil(t, store.CreateUser(&User{Username: "mary", Secret: "3UFC3DUK27KESHBWEJDQS4B2HXLHGFZV"}))
+	assert.Nil(t, store.CreateUser(&User{Username: "james", Secret: "CV4JDXSYVFRJTHMNG4HUKF3OSTOP6B3H"}))
+	assert.ErrorIs(t, store.CreateUser(&User{Username: "mary", Secret: "JBSWY3DPEHPK3PXP"}), ErrUserExists)
+	assert.NotNil(t, store.CreateUser(&User{Username: "bob"}))
+
+	// update
+	assert.Nil(t, store.UpdateUser(&User{Username: "mary", Secret: "KRSXG5CTMVRXEZLU"}))
+	assert.ErrorIs(t, store.UpdateUser(&User{Username: "nobody", Secret: "KRSXG5CTMVRXEZLU"}), ErrUserNotFound)
+	u, err := store.User("mary")
+	assert.Nil(t, err)
+	assert.Equal(t, "KRSXG5CTMVRXEZLU", u.Secret)
+
+	// TOTP options are kept
+	u.TOTPOptions = TOTPOptions{Digits: 8, Period: 60, Algorithm: "SHA256", Skew: 2}
+	assert.Nil(t, store.UpdateUser(u))
+	u, err = store.User("mary")
+	assert.Nil(t, err)
+	assert.Equal(t, TOTPOptions{Digits: 8, Period: 60, Algorithm: "SHA256", Skew: 2}, u.TOTPOptions)
+	assert.NotNil(t, store.UpdateUser(&User{Username: "mary", Secret: "KRSXG5CTMVRXEZLU", TOTPOptions: TOTPOptions{Digits: 7}}))
+
+	// backup codes are kept in order, and replaced on update
+	u.BackupCodes = []string{"sha256:01:aa", "sha256:02:bb"}
+	assert.Nil(t, store.UpdateUser(u))
+	u, err = store.User("mary")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sha256:01:aa", "sha256:02:bb"}, u.BackupCodes)
+	u.BackupCodes = u.BackupCodes[1:]
+	assert.Nil(t, store.UpdateUser(u))
+	u, err = store.User("mary")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sha256:02:bb"}, u.BackupCodes)
+
+	// groups, details & attributes are kept, and replaced on update
+	u.Groups = []string{"dev", "admin"}
+	u.DisplayName = "Mary Smith"
+	u.Email = "mary@example.com"
+	u.Attributes = map[string]string{"team": "platform", "floor": "2"}
+	u.Disabled = true
+	u.PasswordHash = "$2a$10$hash"
+	assert.Nil(t, store.UpdateUser(u))
+	u, err = store.User("mary")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"dev", "admin"}, u.Groups)
+	assert.Equal(t, "Mary Smith", u.DisplayName)
+	assert.Equal(t, "mary@example.com", u.Email)
+	assert.Equal(t, map[string]string{"team": "platform", "floor": "2"}, u.Attributes)
+	assert.True(t, u.Disabled)
+	assert.Equal(t, "$2a$10$hash", u.PasswordHash)
+	u.Groups = nil
+	u.Attributes = nil
+	assert.Nil(t, store.UpdateUser(u))
+	u, err = store.User("mary")
+	assert.Nil(t, err)
+	assert.Empty(t, u.Groups)
+	assert.Empty(t, u.Attributes)
+	assert.NotNil(t, store.UpdateUser(&User{Username: "mary", Secret: "KRSXG5CTMVRXEZLU", Groups: []string{"a,b"}}))
+
+	// list
+	users, err := store.Users()
+	assert.Nil(t, err)
+	assert.Len(t, users, 2)
+	assert.Equal(t, "james", users[0].Username)
+	assert.Equal(t, "mary", users[1].Username)
+
+	// delete
+	assert.Nil(t, store.DeleteUser("james"))
+	assert.ErrorIs(t, store.DeleteUser("james"), ErrUserNotFound)
+	_, err = store.User("james")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func TestOpenStorage(t *testing.T) {
+	cases := []struct {
+		Name        string
+		URL         string
+		ExpectError bool
+	}{
+		{"file", "file://" + copyTestConfig(t), false},
+		{"sqlite", "sqlite://" + filepath.Join(t.TempDir(), "users.db"), false},
+		{"no-scheme", "conf.yaml", true},
+		{"unknown-scheme", "redis://localhost", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			store, err := OpenStorage(c.URL)
+			if c.ExpectError {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			_, ok := store.(WritableStorage)
+			assert.True(t, ok)
+		})
+	}
+}
@@ -1,43 +1,94 @@
 package totp
 
 import (
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	yaml "gopkg.in/yaml.v3"
 )
 
+var (
+	// ErrUserNotFound is returned when a user does not exist in storage
+	ErrUserNotFound = errors.New("User not found")
+
+	// ErrUserExists is returned when creating a user that already exists
+	ErrUserExists = errors.New("User already exists")
+)
+
 // Storage for our user data
 type Storage interface {
 	User(string) (*User, error)
 }
 
+// WritableStorage is a Storage that also supports managing users.
+// Backends may optionally implement this; callers should type assert for it.
+type WritableStorage interface {
+	Storage
+
+	// Users returns all users, sorted by username
+	Users() ([]*User, error)
+
+	// CreateUser adds a new user, returning ErrUserExists if the username is taken
+	CreateUser(*User) error
+
+	// UpdateUser replaces an existing user, returning ErrUserNotFound if there is no such user
+	UpdateUser(*User) error
+
+	// DeleteUser removes a user by username, returning ErrUserNotFound if there is no such user
+	DeleteUser(string) error
+}
+
+// OpenStorage opens a storage backend described by a URL.
+// Supported schemes are
+//   - file://path/to/conf.yaml (a YAML file, see WritableFile)
+//   - sqlite://path/to/users.db (a SQLite database, see SQLite)
+func OpenStorage(url string, opts ...StorageOption) (Storage, error) {
+	scheme, path, ok := strings.Cut(url, "://")
+	if !ok || path == "" {
+		return nil, fmt.Errorf("invalid storage URL %q, expected scheme://path", url)
+	}
+	switch scheme {
+	case "file":
+		return NewWritableFile(path, opts...)
+	case "sqlite":
+		return NewSQLite(path, opts...)
+	}
+	return nil, fmt.Errorf("unsupported storage scheme %q", scheme)
+}
+
 // ReadonlyFile is a simple storage backend that reads from a YAML file.
 // This is Readonly (obviously).
 type ReadonlyFile struct {
 	filename string
+	cipher   *secretCipher
+
+	lock     sync.RWMutex
 	users    map[string]*User
+	checksum [sha256.Size]byte
 }
 
 // NewReadonlyFile creates a new ReadonlyFile storage backend.
-func NewReadonlyFile(filename string) (*ReadonlyFile, error) {
-	data, err := os.ReadFile(filename)
+func NewReadonlyFile(filename string, opts ...StorageOption) (*ReadonlyFile, error) {
+	c, err := newStorageCipher(opts)
 	if err != nil {
 		return nil, err
 	}
-
-	userdata := []*User{}
-	err = yaml.Unmarshal([]byte(data), &userdata)
+	users, checksum, err := readUserFile(filename, c)
 	if err != nil {
 		return nil, err
 	}
-
-	users := make(map[string]*User)
-	for _, user := range userdata {
-		users[user.Username] = user
-	}
-
-	return &ReadonlyFile{filename: filename, users: users}, nil
+	return &ReadonlyFile{filename: filename, cipher: c, users: users, checksum: checksum}, nil
 }
 
 // NewDebugStorage creates a new ReadonlyFile storage backend with canned data (see test_data/conf.yaml).
@@ -55,9 +106,274 @@ func NewDebugStorage() *ReadonlyFile {
 
 // User returns a User object by username.
 func (r *ReadonlyFile) User(username string) (*User, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
 	u, ok := r.users[username]
 	if !ok {
-		return nil, fmt.Errorf("User not found")
+		return nil, ErrUserNotFound
+	}
+	return u.clone(), nil
+}
+
+// Reload re-reads the file, swapping in the new users if the content has changed.
+// If the file can't be read or parsed we keep the users we already have.
+// Returns true if the users were replaced.
+func (r *ReadonlyFile) Reload() (bool, error) {
+	r.lock.RLock()
+	before := r.checksum
+	r.lock.RUnlock()
+
+	users, checksum, err := readUserFile(r.filename, r.cipher)
+	if err != nil {
+		return false, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// if we wrote the file (see WritableFile) while reading it, what we read may be older
+	// than what we hold; skip this time & compare against what we wrote next time
+	if r.checksum != before || checksum == r.checksum {
+		return false, nil
+	}
+	r.users = users
+	r.checksum = checksum
+	return true, nil
+}
+
+// Watch checks the file for changes every interval until the context is cancelled.
+//
+// We poll & compare file content rather than watching the path with inotify because
+// Kubernetes updates secret volumes by atomically swapping a symlink to a new directory,
+// which is easy to miss when watching the file itself.
+func (r *ReadonlyFile) Watch(ctx context.Context, interval time.Duration) {
+	if r.filename == "" || interval <= 0 {
+		return // debug storage, or watching disabled
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.reloadTraced(ctx)
+		}
+	}
+}
+
+// reloadTraced calls Reload, logging & tracing the outcome.
+func (r *ReadonlyFile) reloadTraced(ctx context.Context) {
+	_, span := tracer.Start(ctx, "reload-users")
+	defer span.End()
+	span.SetAttributes(attribute.String("filename", r.filename))
+
+	changed, err := r.Reload()
+	if err != nil {
+		log.Println("Error reloading users, keeping existing users:", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "reload failed")
+		return
+	}
+	span.SetAttributes(attribute.Bool("changed", changed))
+	if changed {
+		r.lock.RLock()
+		count := len(r.users)
+		r.lock.RUnlock()
+
+		log.Println("Reloaded users from", r.filename, "users:", count)
+		span.AddEvent("Users reloaded")
+		span.SetAttributes(attribute.Int("users", count))
+	}
+}
+
+// WritableFile is a storage backend that reads from and writes to a YAML file.
+// Changes are written to a temporary file and renamed over the original, so
+// readers never see a partially written file.
+type WritableFile struct {
+	*ReadonlyFile
+}
+
+// NewWritableFile creates a new WritableFile storage backend.
+func NewWritableFile(filename string, opts ...StorageOption) (*WritableFile, error) {
+	r, err := NewReadonlyFile(filename, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &WritableFile{ReadonlyFile: r}, nil
+}
+
+// Users returns all users, sorted by username.
+func (w *WritableFile) Users() ([]*User, error) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	users := sortedUsers(w.users)
+	for i, u := range users {
+		users[i] = u.clone()
+	}
+	return users, nil
+}
+
+// CreateUser adds a new user and saves the file.
+func (w *WritableFile) CreateUser(user *User) error {
+	if err := user.validate(); err != nil {
+		return err
+	}
+	return w.modify(func(users map[string]*User) error {
+		if _, ok := users[user.Username]; ok {
+			return ErrUserExists
+		}
+		users[user.Username] = user.clone()
+		return nil
+	})
+}
+
+// UpdateUser replaces an existing user and saves the file.
+func (w *WritableFile) UpdateUser(user *User) error {
+	if err := user.validate(); err != nil {
+		return err
+	}
+	return w.modify(func(users map[string]*User) error {
+		if _, ok := users[user.Username]; !ok {
+			return ErrUserNotFound
+		}
+		users[user.Username] = user.clone()
+		return nil
+	})
+}
+
+// DeleteUser removes a user and saves the file.
+func (w *WritableFile) DeleteUser(username string) error {
+	return w.modify(func(users map[string]*User) error {
+		if _, ok := users[username]; !ok {
+			return ErrUserNotFound
+		}
+		delete(users, username)
+		return nil
+	})
+}
+
+// modify applies fn to a copy of our users, writes the result to disk and, if that
+// succeeds, swaps it in. On any error the in memory state is left untouched.
+func (w *WritableFile) modify(fn func(map[string]*User) error) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	users := make(map[string]*User, len(w.users)+1)
+	for k, v := range w.users {
+		users[k] = v
+	}
+	err := fn(users)
+	if err != nil {
+		return err
+	}
+
+	checksum, err := writeUserFile(w.filename, users, w.cipher)
+	if err != nil {
+		return err
+	}
+	w.users = users
+	w.checksum = checksum
+	return nil
+}
+
+// RekeyFile rewrites a YAML user file, decrypting secrets with oldKey and encrypting them with newKey.
+// Either key may be nil, so this also encrypts a plain file (oldKey nil) or decrypts one (newKey nil).
+func RekeyFile(filename string, oldKey, newKey []byte) error {
+	oldCipher, err := newStorageCipher([]StorageOption{WithEncryptionKey(oldKey)})
+	if err != nil {
+		return err
+	}
+	newCipher, err := newStorageCipher([]StorageOption{WithEncryptionKey(newKey)})
+	if err != nil {
+		return err
+	}
+
+	users, _, err := readUserFile(filename, oldCipher)
+	if err != nil {
+		return err
+	}
+	_, err = writeUserFile(filename, users, newCipher)
+	return err
+}
+
+// readUserFile reads a YAML list of users from disk, along with a checksum of the file content.
+// Encrypted secrets are decrypted with the given cipher.
+func readUserFile(filename string, c *secretCipher) (map[string]*User, [sha256.Size]byte, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, [sha256.Size]byte{}, err
+	}
+
+	userdata := []*User{}
+	err = yaml.Unmarshal([]byte(data), &userdata)
+	if err != nil {
+		return nil, [sha256.Size]byte{}, err
+	}
+
+	users := make(map[string]*User)
+	for _, user := range userdata {
+		user.Secret, err = decryptSecret(c, user.Username, user.Secret)
+		if err != nil {
+			return nil, [sha256.Size]byte{}, err
+		}
+		users[user.Username] = user
+	}
+	return users, sha256.Sum256(data), nil
+}
+
+// writeUserFile atomically writes a YAML list of users to disk, returning a checksum of the content.
+// Secrets are encrypted with the given cipher, if any.
+func writeUserFile(filename string, users map[string]*User, c *secretCipher) ([sha256.Size]byte, error) {
+	checksum := [sha256.Size]byte{}
+
+	userdata := sortedUsers(users)
+	for i, u := range userdata {
+		enc, err := encryptSecret(c, u.Username, u.Secret)
+		if err != nil {
+			return checksum, err
+		}
+		userdata[i] = u.clone()
+		userdata[i].Secret = enc
+	}
+
+	data, err := yaml.Marshal(userdata)
+	if err != nil {
+		return checksum, err
+	}
+
+	// write to a temp file in the same directory, so the rename is atomic.
+	// CreateTemp gives us 0600 permissions, which is what we want for secrets anyways.
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return checksum, err
+	}
+	defer os.Remove(tmp.Name()) // no-op if the rename succeeded
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return checksum, fmt.Errorf("failed to write %s: %w", filename, err)
+	}
+
+	return sha256.Sum256(data), os.Rename(tmp.Name(), filename)
+}
+
+// sortedUsers returns the users in the given map sorted by username.
+func sortedUsers(users map[string]*User) []*User {
+	result := make([]*User, 0, len(users))
+	for _, u := range users {
+		result = append(result, u)
 	}
-	return u, nil
+	sort.Slice(result, func(i, j int) bool { return result[i].Username < result[j].Username })
+	return result
 }
@@ -0,0 +1,29 @@
+package totp
+
+// storageConfig holds settings common to our storage backends
+type storageConfig struct {
+	encryptionKey []byte
+}
+
+type StorageOption func(*storageConfig)
+
+// WithEncryptionKey sets the key used to encrypt TOTP secrets at rest.
+// Encrypted secrets are stored as "enc:v1:..." and decrypted when loaded, plain secrets
+// are still accepted. When set, secrets are encrypted whenever the backend writes them.
+func WithEncryptionKey(key []byte) StorageOption {
+	return func(c *storageConfig) {
+		c.encryptionKey = key
+	}
+}
+
+// newStorageCipher applies the given options, returning the cipher to use for secrets (if any).
+func newStorageCipher(opts []StorageOption) (*secretCipher, error) {
+	c := &storageConfig{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.encryptionKey == nil {
+		return nil, nil
+	}
+	return newSecretCipher(c.encryptionKey)
+}
@@ -0,0 +1,164 @@
+package totp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func copyTestConfig(t *testing.T) string {
+	data, err := os.ReadFile("test_data/conf.yaml")
+	assert.Nil(t, err)
+
+	filename := filepath.Join(t.TempDir(), "conf.yaml")
+	assert.Nil(t, os.WriteFile(filename, data, 0600))
+	return filename
+}
+
+func TestReadonlyFile(t *testing.T) {
+	store, err := NewReadonlyFile("test_data/conf.yaml")
+	assert.Nil(t, err)
+
+	u, err := store.User("mary")
+	assert.Nil(t, err)
+	assert.Equal(t, "3UFC3DUK27KESHBWEJDQS4B2HXLHGFZV", u.Secret)
+
+	_, err = store.User("nobody")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func TestWritableFile(t *testing.T) {
+	filename := copyTestConfig(t)
+
+	store, err := NewWritableFile(filename)
+	assert.Nil(t, err)
+
+	// create
+	assert.Nil(t, store.CreateUser(&User{Username: "alice", Secret: "JBSWY3DPEHPK3PXP"}))
+	assert.ErrorIs(t, store.CreateUser(&User{Username: "alice", Secret: "JBSWY3DPEHPK3PXP"}), ErrUserExists)
+	assert.NotNil(t, store.CreateUser(&User{Username: "bob"}))
+
+	// update
+	assert.Nil(t, store.UpdateUser(&User{Username: "mary", Secret: "KRSXG5CTMVRXEZLU"}))
+	assert.ErrorIs(t, store.UpdateUser(&User{Username: "nobody", Secret: "KRSXG5CTMVRXEZLU"}), ErrUserNotFound)
+
+	// delete
+	assert.Nil(t, store.DeleteUser("james"))
+	assert.ErrorIs(t, store.DeleteUser("james"), ErrUserNotFound)
+
+	// list
+	users, err := store.Users()
+	assert.Nil(t, err)
+	names := []string{}
+	for _, u := range users {
+		names = append(names, u.Username)
+	}
+	assert.Equal(t, []string{"alice", "mary", "test"}, names)
+
+	// modifying a returned user doesn't change storage
+	users[0].Secret = "changed"
+	u, err := store.User("alice")
+	assert.Nil(t, err)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", u.Secret)
+
+	// user details are kept
+	details := &User{
+		Username:     "test",
+		Secret:       "DSENNVUPIDGLGIH5XE5F7EXPZIZAVZJH",
+		Groups:       []string{"admin"},
+		DisplayName:  "Test User",
+		Email:        "test@example.com",
+		Attributes:   map[string]string{"team": "platform"},
+		Disabled:     true,
+		PasswordHash: "$2a$10$hash",
+	}
+	assert.Nil(t, store.UpdateUser(details))
+
+	// changes were persisted
+	reloaded, err := NewReadonlyFile(filename)
+	assert.Nil(t, err)
+	u, err = reloaded.User("mary")
+	assert.Nil(t, err)
+	assert.Equal(t, "KRSXG5CTMVRXEZLU", u.Secret)
+	u, err = reloaded.User("test")
+	assert.Nil(t, err)
+	assert.Equal(t, details, u)
+	_, err = reloaded.User("james")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	// no temp files left behind
+	entries, err := os.ReadDir(filepath.Dir(filename))
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestReadonlyFileReload(t *testing.T) {
+	// mimic a kubernetes secret volume, where conf.yaml -> ..data/conf.yaml and ..data -> a timestamped dir
+	dir := t.TempDir()
+	writeVersion := func(name, content string) {
+		assert.Nil(t, os.Mkdir(filepath.Join(dir, name), 0700))
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, name, "conf.yaml"), []byte(content), 0600))
+		assert.Nil(t, os.Symlink(name, filepath.Join(dir, "..data_tmp")))
+		assert.Nil(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+	}
+	writeVersion("v1", "- username: mary\n  secret: 3UFC3DUK27KESHBWEJDQS4B2HXLHGFZV\n")
+	filename := filepath.Join(dir, "conf.yaml")
+	assert.Nil(t, os.Symlink(filepath.Join("..data", "conf.yaml"), filename))
+
+	store, err := NewReadonlyFile(filename)
+	assert.Nil(t, err)
+
+	// nothing changed
+	changed, err := store.Reload()
+	assert.Nil(t, err)
+	assert.False(t, changed)
+
+	// symlink swapped to a new version
+	writeVersion("v2", "- username: james\n  secret: CV4JDXSYVFRJTHMNG4HUKF3OSTOP6B3H\n")
+	changed, err = store.Reload()
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	_, err = store.User("mary")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	_, err = store.User("james")
+	assert.Nil(t, err)
+
+	// broken file keeps the old users
+	writeVersion("v3", "- username: [this is not valid\n")
+	changed, err = store.Reload()
+	assert.NotNil(t, err)
+	assert.False(t, changed)
+	_, err = store.User("james")
+	assert.Nil(t, err)
+}
+
+func TestWritableFileReloadDuringWrite(t *testing.T) {
+	store, err := NewWritableFile(copyTestConfig(t))
+	assert.Nil(t, err)
+
+	// a reload racing a write must never swap in the file as it was before the write
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			assert.Nil(t, store.CreateUser(&User{Username: fmt.Sprintf("user%d", i), Secret: "3UFC3DUK27KESHBWEJDQS4B2HXLHGFZV"}))
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+			_, err := store.Reload()
+			assert.Nil(t, err)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		_, err := store.User(fmt.Sprintf("user%d", i))
+		assert.Nil(t, err)
+	}
+}
@@ -0,0 +1,114 @@
+package totp
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defaultTemplates are our built in pages, any of which can be replaced (see WithTemplateDir).
+//
+//go:embed templates/*.html
+var defaultTemplates embed.FS
+
+const (
+	loginTemplate  = "login.html"
+	errorTemplate  = "error.html"
+	enrollTemplate = "enroll.html"
+	logoutTemplate = "logout.html"
+)
+
+// loginPage is the data available to the login template.
+type loginPage struct {
+	// LoginURL is where the form should be POSTed
+	LoginURL string
+
+	// CSRF token, to be sent back as the "csrf" field
+	CSRF string
+
+	// ReturnTo is where the user will be sent after logging in, if not the default
+	ReturnTo string
+
+	// Username the user tried to log in as, if any
+	Username string
+
+	// Error describes why the last login failed, if it did
+	Error string
+
+	// Reason is the machine readable reason the last login failed (eg. invalid_code), if it did
+	Reason string
+
+	// LockoutRemaining is how long until the user or client may try again, if locked out or rate limited
+	LockoutRemaining time.Duration
+}
+
+// logoutPage is the data available to the logout template.
+type logoutPage struct {
+	// LogoutURL is where the form should be POSTed
+	LogoutURL string
+
+	// CSRF token, to be sent back as the "csrf" field
+	CSRF string
+
+	// Username of the user logging out
+	Username string
+}
+
+// errorPage is the data available to the error template.
+type errorPage struct {
+	Status     int
+	StatusText string
+	Message    string
+}
+
+// loadTemplates parses our page templates, preferring those found in dir (if given) over the built in ones.
+func loadTemplates(dir string) (*template.Template, error) {
+	t, err := template.ParseFS(defaultTemplates, "templates/*.html")
+	if err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		return t, nil
+	}
+
+	for _, name := range []string{loginTemplate, errorTemplate, enrollTemplate, logoutTemplate} {
+		filename := filepath.Join(dir, name)
+		data, err := os.ReadFile(filename)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		_, err = t.New(name).Parse(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", filename, err)
+		}
+	}
+	return t, nil
+}
+
+// renderTemplate writes a page to the response. Pages are rendered to memory first, so
+// a template error gives a plain 500 rather than a half written page.
+func (s *server) renderTemplate(w http.ResponseWriter, name string, data interface{}, status int) {
+	buf := &bytes.Buffer{}
+	err := s.templates.ExecuteTemplate(buf, name, data)
+	if err != nil {
+		log.Println("Error rendering template:", name, err)
+		writeError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// writeErrorPage writes an error page for browsers (see writeError for everything else).
+func (s *server) writeErrorPage(w http.ResponseWriter, msg string, status int) {
+	s.renderTemplate(w, errorTemplate, &errorPage{Status: status, StatusText: http.StatusText(status), Message: msg}, status)
+}
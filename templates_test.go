@@ -0,0 +1,48 @@
+package totp
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadTemplates(t *testing.T) {
+	// built in pages escape values
+	tmpl, err := loadTemplates("")
+	assert.Nil(t, err)
+	buf := &bytes.Buffer{}
+	err = tmpl.ExecuteTemplate(buf, loginTemplate, &loginPage{
+		LoginURL:         "/auth/login",
+		CSRF:             "token",
+		Username:         `"><script>`,
+		Error:            failureLockedOut.message(),
+		LockoutRemaining: 30 * time.Second,
+	})
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), `value="token"`)
+	assert.Contains(t, buf.String(), "try again in 30s")
+	assert.NotContains(t, buf.String(), "<script>")
+
+	// a directory overrides some or all of them
+	dir := t.TempDir()
+	err = os.WriteFile(filepath.Join(dir, loginTemplate), []byte(`custom {{.CSRF}}`), 0600)
+	assert.Nil(t, err)
+	tmpl, err = loadTemplates(dir)
+	assert.Nil(t, err)
+	buf.Reset()
+	assert.Nil(t, tmpl.ExecuteTemplate(buf, loginTemplate, &loginPage{CSRF: "token"}))
+	assert.Equal(t, "custom token", buf.String())
+	buf.Reset()
+	assert.Nil(t, tmpl.ExecuteTemplate(buf, errorTemplate, &errorPage{Status: 500, Message: "oops"}))
+	assert.Contains(t, buf.String(), "oops")
+
+	// broken templates are an error
+	err = os.WriteFile(filepath.Join(dir, errorTemplate), []byte(`{{.Broken`), 0600)
+	assert.Nil(t, err)
+	_, err = loadTemplates(dir)
+	assert.NotNil(t, err)
+}
@@ -2,18 +2,106 @@ package totp
 
 import (
 	"bytes"
+	"crypto/subtle"
+	"fmt"
 	"image"
 	"image/png"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
-	// "github.com/pquerna/otp"
+	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
 )
 
+const (
+	// defaultTOTPPeriod is the number of seconds a TOTP code is valid for
+	defaultTOTPPeriod = 30
+
+	// defaultTOTPSkew is the number of periods either side of now we accept codes for
+	defaultTOTPSkew = 1
+)
+
+// TOTPOptions are the (optional) parameters of a user's TOTP codes.
+// Zero values mean the defaults most authenticator apps expect: 6 digits, a 30 second period & SHA1.
+type TOTPOptions struct {
+	// Number of digits in a code (6 or 8)
+	Digits int `yaml:"digits,omitempty"`
+
+	// Seconds each code is valid for
+	Period uint `yaml:"period,omitempty"`
+
+	// Hash algorithm; SHA1, SHA256, SHA512 or MD5
+	Algorithm string `yaml:"algorithm,omitempty"`
+
+	// Periods either side of now that we accept codes for, to allow for clock drift.
+	// Zero means the default of 1, negative values mean only the current period.
+	Skew int `yaml:"skew,omitempty"`
+}
+
+// validate checks the options are ones we support
+func (o TOTPOptions) validate() error {
+	_, _, err := o.validateOpts()
+	return err
+}
+
+// validateOpts returns the options (with defaults applied) in the form our TOTP library wants,
+// along with the skew.
+func (o TOTPOptions) validateOpts() (totp.ValidateOpts, int, error) {
+	opts := totp.ValidateOpts{
+		Period:    defaultTOTPPeriod,
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	}
+	skew := defaultTOTPSkew
+
+	if o.Period > 0 {
+		opts.Period = o.Period
+	}
+	switch o.Digits {
+	case 0, 6:
+	case 8:
+		opts.Digits = otp.DigitsEight
+	default:
+		return opts, 0, fmt.Errorf("unsupported number of TOTP digits %d (expected 6 or 8)", o.Digits)
+	}
+	switch strings.ToUpper(o.Algorithm) {
+	case "", "SHA1":
+	case "SHA256":
+		opts.Algorithm = otp.AlgorithmSHA256
+	case "SHA512":
+		opts.Algorithm = otp.AlgorithmSHA512
+	case "MD5":
+		opts.Algorithm = otp.AlgorithmMD5
+	default:
+		return opts, 0, fmt.Errorf("unsupported TOTP algorithm %q", o.Algorithm)
+	}
+	if o.Skew < 0 {
+		skew = 0
+	} else if o.Skew > 0 {
+		skew = o.Skew
+	}
+	return opts, skew, nil
+}
+
 // NewTOTP creates a new TOTP key for the given account.
 func NewTOTP(issuer, account string) (string, image.Image, []byte, error) {
+	return NewTOTPWithOptions(issuer, account, TOTPOptions{})
+}
+
+// NewTOTPWithOptions creates a new TOTP key for the given account, with the given code parameters.
+func NewTOTPWithOptions(issuer, account string, o TOTPOptions) (string, image.Image, []byte, error) {
+	vopts, _, err := o.validateOpts()
+	if err != nil {
+		return "", nil, nil, err
+	}
 	key, err := totp.Generate(totp.GenerateOpts{
 		Issuer:      issuer,
 		AccountName: account,
+		Period:      vopts.Period,
+		Digits:      vopts.Digits,
+		Algorithm:   vopts.Algorithm,
 	})
 	if err != nil {
 		return "", nil, nil, err
@@ -29,7 +117,60 @@ func NewTOTP(issuer, account string) (string, image.Image, []byte, error) {
 	return key.Secret(), img, buf.Bytes(), err
 }
 
-// validateTOTP validates the given TOTP code against the secret.
-func validateTOTP(secret, code string) bool {
-	return totp.Validate(code, secret)
+// totpKey returns the key (as shown to authenticator apps) for an existing TOTP secret with the given options.
+func totpKey(issuer, account, secret string, o TOTPOptions) (*otp.Key, error) {
+	opts, _, err := o.validateOpts()
+	if err != nil {
+		return nil, err
+	}
+	u := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + issuer + ":" + account,
+		RawQuery: url.Values{
+			"secret":    {secret},
+			"issuer":    {issuer},
+			"digits":    {opts.Digits.String()},
+			"period":    {strconv.FormatUint(uint64(opts.Period), 10)},
+			"algorithm": {opts.Algorithm.String()},
+		}.Encode(),
+	}
+	return otp.NewKeyFromURL(u.String())
+}
+
+// totpQRCode returns a PNG QR code for an existing TOTP secret with the given options.
+func totpQRCode(issuer, account, secret string, o TOTPOptions) ([]byte, error) {
+	key, err := totpKey(issuer, account, secret, o)
+	if err != nil {
+		return nil, err
+	}
+	img, err := key.Image(200, 200)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = png.Encode(&buf, img)
+	return buf.Bytes(), err
+}
+
+// validateTOTP validates the given TOTP code against the user's secret at the given time.
+// Returns the start (unix seconds) of the time step the code was generated for, so callers
+// can refuse to accept the same (or an older) step twice.
+func validateTOTP(user *User, code string, now time.Time) (uint64, bool) {
+	opts, skew, err := user.TOTPOptions.validateOpts()
+	if err != nil {
+		return 0, false
+	}
+	period := int64(opts.Period)
+	for i := -skew; i <= skew; i++ {
+		t := now.Add(time.Duration(int64(i)*period) * time.Second)
+		expect, err := totp.GenerateCodeCustom(user.Secret, t, opts)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expect), []byte(code)) == 1 {
+			return uint64(t.Unix() / period * period), true
+		}
+	}
+	return 0, false
 }
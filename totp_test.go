@@ -0,0 +1,112 @@
+package totp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateTOTP(t *testing.T) {
+	secret := "3UFC3DUK27KESHBWEJDQS4B2HXLHGFZV"
+	now := time.Unix(1700000000, 0)
+	step := uint64(1700000000 / 30 * 30)
+
+	code := func(at time.Time, opts totp.ValidateOpts) string {
+		c, err := totp.GenerateCodeCustom(secret, at, opts)
+		assert.Nil(t, err)
+		return c
+	}
+	defaults := totp.ValidateOpts{Period: 30, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+	custom := totp.ValidateOpts{Period: 60, Digits: otp.DigitsEight, Algorithm: otp.AlgorithmSHA256}
+	customUser := TOTPOptions{Digits: 8, Period: 60, Algorithm: "sha256"}
+
+	cases := []struct {
+		Name       string
+		Options    TOTPOptions
+		Code       string
+		ExpectOK   bool
+		ExpectStep uint64
+	}{
+		{"current", TOTPOptions{}, code(now, defaults), true, step},
+		{"previous-step", TOTPOptions{}, code(now.Add(-30*time.Second), defaults), true, step - 30},
+		{"next-step", TOTPOptions{}, code(now.Add(30*time.Second), defaults), true, step + 30},
+		{"too-old", TOTPOptions{}, code(now.Add(-90*time.Second), defaults), false, 0},
+		{"no-skew", TOTPOptions{Skew: -1}, code(now.Add(-30*time.Second), defaults), false, 0},
+		{"big-skew", TOTPOptions{Skew: 3}, code(now.Add(-90*time.Second), defaults), true, step - 90},
+		{"wrong", TOTPOptions{}, "000000", false, 0},
+		{"empty", TOTPOptions{}, "", false, 0},
+		{"custom", customUser, code(now, custom), true, 1700000000 / 60 * 60},
+		{"custom-wrong-options", TOTPOptions{}, code(now, custom), false, 0},
+		{"bad-options", TOTPOptions{Algorithm: "rot13"}, code(now, defaults), false, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			u := &User{Username: "mary", Secret: secret, TOTPOptions: c.Options}
+			step, ok := validateTOTP(u, c.Code, now)
+			assert.Equal(t, c.ExpectOK, ok)
+			assert.Equal(t, c.ExpectStep, step)
+		})
+	}
+}
+
+func TestTOTPKey(t *testing.T) {
+	secret := "3UFC3DUK27KESHBWEJDQS4B2HXLHGFZV"
+
+	key, err := totpKey("example.org", "mary", secret, TOTPOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, secret, key.Secret())
+	assert.Equal(t, otp.DigitsSix, key.Digits())
+	assert.Equal(t, uint64(30), key.Period())
+	assert.Equal(t, otp.AlgorithmSHA1, key.Algorithm())
+
+	// the QR code has the user's own options, so their app generates the right codes
+	key, err = totpKey("example.org", "mary", secret, TOTPOptions{Digits: 8, Period: 60, Algorithm: "sha256"})
+	assert.Nil(t, err)
+	assert.Equal(t, otp.DigitsEight, key.Digits())
+	assert.Equal(t, uint64(60), key.Period())
+	assert.Equal(t, otp.AlgorithmSHA256, key.Algorithm())
+
+	_, err = totpKey("example.org", "mary", secret, TOTPOptions{Digits: 7})
+	assert.NotNil(t, err)
+	_, err = totpQRCode("example.org", "mary", secret, TOTPOptions{Digits: 8})
+	assert.Nil(t, err)
+}
+
+func TestReplayStores(t *testing.T) {
+	stores := map[string]ReplayStore{
+		"memory": NewMemoryReplayStore(),
+		"sqlite": newTestSQLite(t),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ok, err := store.Accept("mary", 100)
+			assert.Nil(t, err)
+			assert.True(t, ok)
+
+			// same step again
+			ok, err = store.Accept("mary", 100)
+			assert.Nil(t, err)
+			assert.False(t, ok)
+
+			// older step
+			ok, err = store.Accept("mary", 99)
+			assert.Nil(t, err)
+			assert.False(t, ok)
+
+			// newer step
+			ok, err = store.Accept("mary", 101)
+			assert.Nil(t, err)
+			assert.True(t, ok)
+
+			// other users are independent
+			ok, err = store.Accept("james", 100)
+			assert.Nil(t, err)
+			assert.True(t, ok)
+		})
+	}
+}
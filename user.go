@@ -1,5 +1,10 @@
 package totp
 
+import (
+	"fmt"
+	"strings"
+)
+
 // User object holds the bare minimum
 type User struct {
 	// Some uniqe string
@@ -7,4 +12,59 @@ type User struct {
 
 	// TOTP secret
 	Secret string `yaml:"secret"`
+
+	// Optional TOTP parameters (digits, period etc), if not the defaults
+	TOTPOptions `yaml:",inline"`
+
+	// Hashes of one-time backup codes, accepted in place of a TOTP code (see NewBackupCodes)
+	BackupCodes []string `yaml:"backup_codes,omitempty"`
+
+	// Groups the user belongs to, for authorization (see Policy)
+	Groups []string `yaml:"groups,omitempty"`
+
+	// Optional details about the user, passed on in their JWT
+	DisplayName string            `yaml:"display_name,omitempty"`
+	Email       string            `yaml:"email,omitempty"`
+	Attributes  map[string]string `yaml:"attributes,omitempty"`
+
+	// Disabled users can't log in
+	Disabled bool `yaml:"disabled,omitempty"`
+
+	// Optional bcrypt hash of a password, which HTTP Basic auth requires before the code (see BasicAuthMode)
+	PasswordHash string `yaml:"password_hash,omitempty"`
+}
+
+// validate checks the user has the fields we require before it is stored
+func (u *User) validate() error {
+	if u.Username == "" {
+		return fmt.Errorf("username is required")
+	}
+	if u.Secret == "" {
+		return fmt.Errorf("secret is required")
+	}
+	for _, g := range u.Groups {
+		// groups are sent comma separated in headers, so can't contain commas themselves
+		if g == "" || strings.Contains(g, ",") {
+			return fmt.Errorf("invalid group %q", g)
+		}
+	}
+	return u.TOTPOptions.validate()
+}
+
+// clone returns a copy of the user, so callers can't modify data held by storage
+func (u *User) clone() *User {
+	c := *u
+	if u.BackupCodes != nil {
+		c.BackupCodes = append([]string{}, u.BackupCodes...)
+	}
+	if u.Groups != nil {
+		c.Groups = append([]string{}, u.Groups...)
+	}
+	if u.Attributes != nil {
+		c.Attributes = make(map[string]string, len(u.Attributes))
+		for k, v := range u.Attributes {
+			c.Attributes[k] = v
+		}
+	}
+	return &c
 }
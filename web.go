@@ -2,43 +2,87 @@ package totp
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"html/template"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/golang-lru/v2/expirable"
 
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // server is our HTTP server
 type server struct {
 	// configurable
 	csrfKey              []byte
-	jwtKey               []byte
+	jwtKeys              *JWTKeyring
 	port                 int
+	grpcPort             int
 	cacheSize            int
 	cacheTTL             time.Duration
 	jwtSessionTTL        time.Duration
 	redirect             string
 	authCheckURL         string
 	authLoginURL         string
+	authLogoutURL        string
+	authForwardURL       string
+	loginRedirectURL     string
+	cookieDomain         string
+	jwksURL              string
 	store                Storage
+	replay               ReplayStore
+	revocations          RevocationStore
 	secondsBetweenLogins int64
 	cookieName           string
 	httpReadTimeout      time.Duration
 	httpWriteTimeout     time.Duration
+	clientIPHeader       string
+	lockoutThreshold     int
+	lockoutBaseDelay     time.Duration
+	lockoutMaxDelay      time.Duration
+	lockoutReset         time.Duration
+	lockoutCacheSize     int
+	loginBurst           int
+	rateLimitKey         RateLimitKey
+	rateLimitCacheSize   int
+	userHeader           string
+	groupsHeader         string
+	expiresHeader        string
+	policy               *Policy
+	redirectAllowList    []string
+	templateDir          string
+	inviteKey            []byte
+	authEnrollURL        string
+	authAPILoginURL      string
+	tokenPrecedence      TokenPrecedence
+	basicAuth            BasicAuthMode
+	basicAuthTTL         time.Duration
+	basicAuthCacheSize   int
+	issuer               string
+	adminURL             string
+	adminToken           string
+	adminGroup           string
 
 	// internal
-	sessions  *expirable.LRU[string, bool]
-	re        *regexp.Regexp
-	lastLogin int64
+	sessions      *expirable.LRU[string, bool]
+	basicSessions *expirable.LRU[string, *JWTClaim]
+	re            *regexp.Regexp
+	limiter       *rateLimiter
+	userLockout   *lockout
+	ipLockout     *lockout
+	backupLock    sync.Mutex
+	templates     *template.Template
 }
 
 // buildServer creates a new server with the given options - this allows us to track server state
@@ -53,27 +97,99 @@ func buildServer(opts ...WebOption) (*server, error) {
 		redirect:             "/auth/check",
 		authCheckURL:         "/auth/check",
 		authLoginURL:         "/auth/login",
+		authLogoutURL:        "/auth/logout",
+		authForwardURL:       "/auth/forward",
+		authEnrollURL:        "/auth/enroll",
+		authAPILoginURL:      "/auth/api/login",
+		tokenPrecedence:      TokenCookieFirst,
+		basicAuth:            BasicAuthOff,
+		basicAuthTTL:         time.Minute * 15,
+		basicAuthCacheSize:   10000,
+		issuer:               "totp",
+		adminURL:             "/admin/api/users",
+		jwksURL:              "/.well-known/jwks.json",
 		cookieName:           "totp-auth",
 		secondsBetweenLogins: 1,
-		re:                   regexp.MustCompile(`^[a-zA-Z0-9]+`),
+		re:                   regexp.MustCompile(`^[a-zA-Z0-9]+$`),
 		httpReadTimeout:      time.Second,
 		httpWriteTimeout:     time.Second,
+		lockoutThreshold:     5,
+		lockoutBaseDelay:     time.Second * 30,
+		lockoutMaxDelay:      time.Minute * 15,
+		lockoutReset:         time.Hour,
+		lockoutCacheSize:     10000,
+		loginBurst:           3,
+		rateLimitKey:         RateLimitByIP,
+		rateLimitCacheSize:   10000,
+		userHeader:           "X-Auth-User",
+		groupsHeader:         "X-Auth-Groups",
+		expiresHeader:        "X-Auth-Expires",
 	}
 	for _, opt := range opts { // apply options
 		opt(s)
 	}
 	s.sessions = expirable.NewLRU[string, bool](s.cacheSize, nil, s.cacheTTL)
+	s.basicSessions = expirable.NewLRU[string, *JWTClaim](s.basicAuthCacheSize, nil, s.basicAuthTTL)
+	s.userLockout = newLockout(s.lockoutCacheSize, s.lockoutThreshold, s.lockoutBaseDelay, s.lockoutMaxDelay, s.lockoutReset)
+	s.ipLockout = newLockout(s.lockoutCacheSize, s.lockoutThreshold, s.lockoutBaseDelay, s.lockoutMaxDelay, s.lockoutReset)
 
 	// validate our configuration
 	if s.csrfKey == nil {
 		return nil, fmt.Errorf("CSRF key is required")
 	}
-	if s.jwtKey == nil {
+	if s.jwtKeys == nil || s.jwtKeys.Active() == nil {
 		return nil, fmt.Errorf("JWT key is required")
+	} else if !s.jwtKeys.Active().CanSign() {
+		return nil, fmt.Errorf("JWT key must be able to sign (a private key)")
+	}
+	for _, k := range s.jwtKeys.Keys() {
+		if k.empty() {
+			return nil, fmt.Errorf("JWT key %q is empty", k.ID)
+		}
 	}
 	if s.store == nil {
 		return nil, fmt.Errorf("Storage is required")
 	}
+	if _, ok := s.store.(WritableStorage); len(s.inviteKey) > 0 && !ok {
+		return nil, fmt.Errorf("Enrollment requires writable storage")
+	}
+	if len(s.inviteKey) > 0 {
+		if string(s.inviteKey) == string(s.csrfKey) {
+			return nil, fmt.Errorf("The invite key must differ from the CSRF key")
+		}
+		for _, k := range s.jwtKeys.Keys() {
+			if k.hasSecret(s.inviteKey) {
+				return nil, fmt.Errorf("The invite key must differ from the JWT key")
+			}
+		}
+	}
+	if _, ok := s.store.(WritableStorage); s.adminEnabled() && !ok {
+		return nil, fmt.Errorf("The admin API requires writable storage")
+	}
+	if s.replay == nil {
+		s.replay = NewMemoryReplayStore()
+	}
+	if s.revocations == nil {
+		s.revocations = NewMemoryRevocationStore()
+	}
+	if err := s.rateLimitKey.validate(); err != nil {
+		return nil, err
+	}
+	if err := s.tokenPrecedence.validate(); err != nil {
+		return nil, err
+	}
+	if err := s.basicAuth.validate(); err != nil {
+		return nil, err
+	}
+	limiter, err := newRateLimiter(s.rateLimitCacheSize, time.Duration(s.secondsBetweenLogins)*time.Second, s.loginBurst)
+	if err != nil {
+		return nil, err
+	}
+	s.limiter = limiter
+	s.templates, err = loadTemplates(s.templateDir)
+	if err != nil {
+		return nil, err
+	}
 
 	return s, nil
 }
@@ -105,12 +221,26 @@ func ServeHTTP(opts ...WebOption) error {
 		WriteTimeout: s.httpWriteTimeout,
 		Handler:      s.newHTTPHandler(),
 	}
-	srvErr := make(chan error, 1)
+	srvErr := make(chan error, 2)
 	go func() {
 		log.Println("Server is running at :", s.port)
 		srvErr <- srv.ListenAndServe()
 	}()
 
+	// and the Envoy ext_authz gRPC server, if enabled
+	if s.grpcPort > 0 {
+		lis, err := net.Listen("tcp", fmt.Sprintf(":%d", s.grpcPort))
+		if err != nil {
+			return err
+		}
+		g := s.newGRPCServer()
+		defer g.GracefulStop()
+		go func() {
+			log.Println("gRPC server is running at :", s.grpcPort)
+			srvErr <- g.Serve(lis)
+		}()
+	}
+
 	// Wait for interruption.
 	select {
 	case err = <-srvErr:
@@ -135,12 +265,33 @@ func (s *server) newHTTPHandler() http.Handler {
 	// Add the /auth/check and /auth/login endpoints.
 	mux.Handle(s.authCheckURL, otelWrapHandler(http.HandlerFunc(s.authCheck), s.authCheckURL))
 	mux.Handle(s.authLoginURL, otelWrapHandler(http.HandlerFunc(s.authLogin), s.authLoginURL))
+	if s.authForwardURL != "" {
+		mux.Handle(s.authForwardURL, otelWrapHandler(http.HandlerFunc(s.authForward), s.authForwardURL))
+	}
+	if s.authAPILoginURL != "" {
+		mux.Handle(s.authAPILoginURL, otelWrapHandler(http.HandlerFunc(s.authAPILogin), s.authAPILoginURL))
+	}
+	if len(s.inviteKey) > 0 && s.authEnrollURL != "" {
+		mux.Handle(s.authEnrollURL, otelWrapHandler(http.HandlerFunc(s.authEnroll), s.authEnrollURL))
+	}
+	if s.adminEnabled() {
+		mux.Handle(s.adminURL, otelWrapHandler(http.HandlerFunc(s.adminUsers), s.adminURL))
+		mux.Handle(s.adminURL+"/", otelWrapHandler(http.HandlerFunc(s.adminUsers), s.adminURL))
+	}
+	if s.authLogoutURL != "" {
+		mux.Handle(s.authLogoutURL, otelWrapHandler(http.HandlerFunc(s.authLogout), s.authLogoutURL))
+	}
+
+	// Publish our public key(s), so others can verify our JWTs
+	if s.jwksURL != "" {
+		mux.Handle(s.jwksURL, otelWrapHandler(http.HandlerFunc(s.jwks), s.jwksURL))
+	}
 
 	return mux
 }
 
 // authCheck is the handler for the /auth/check endpoint.
-// Validates that a user is logged in (JWT cookie is present and valid).
+// Validates that a user is logged in (JWT cookie or bearer token is present and valid) and, if we have a policy, may access the original request.
 func (s *server) authCheck(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		log.Println("Method not allowed", r.Method)
@@ -148,28 +299,298 @@ func (s *server) authCheck(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cookie, err := r.Cookie(s.cookieName)
-	if err != nil {
-		log.Println("No cookie found")
-		writeError(w, "Unauthorized", http.StatusUnauthorized)
+	jwt, status := s.authorize(r, originalHeaders)
+	if status != http.StatusOK {
+		if status == http.StatusUnauthorized && s.basicAuth != BasicAuthOff {
+			// so clients like curl & git know to send credentials
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+s.issuer+`"`)
+		}
+		writeError(w, http.StatusText(status), status)
 		return
 	}
 
-	jwt, err := validateJWT(s.jwtKey, cookie.Value)
-	if err != nil {
-		log.Println("Invalid JWT:", err)
-		writeError(w, "Unauthorized", http.StatusUnauthorized)
+	s.setIdentityHeaders(w.Header(), jwt)
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Welcome"))
+}
+
+// authForward is the handler for the /auth/forward endpoint, for Traefik's forwardAuth & Caddy's forward_auth.
+// Like authCheck, but these proxies expect us to redirect users who aren't logged in to the login page
+// ourselves, and tell us about the original request with X-Forwarded-Method/Proto/Host/Uri.
+// The forwarded request's own method is whatever the proxy chooses, so any is accepted.
+func (s *server) authForward(w http.ResponseWriter, r *http.Request) {
+	jwt, status := s.authorize(r, forwardedHeaders)
+	if status == http.StatusUnauthorized {
+		w.Header().Set("Location", s.forwardLoginURL(r))
+		w.WriteHeader(http.StatusFound)
 		return
+	} else if status != http.StatusOK {
+		writeError(w, http.StatusText(status), status)
+		return
+	}
+
+	s.setIdentityHeaders(w.Header(), jwt)
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Welcome"))
+}
+
+// forwardLoginURL returns where to send a user who needs to log in, with the URL they
+// were trying to reach (if the proxy told us) as the rd parameter.
+func (s *server) forwardLoginURL(r *http.Request) string {
+	login := s.authLoginURL
+	if s.loginRedirectURL != "" {
+		login = s.loginRedirectURL
+	}
+
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		return login
+	}
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if proto == "" {
+		proto = "https"
+	}
+	rd := proto + "://" + host + r.Header.Get("X-Forwarded-Uri")
+
+	sep := "?"
+	if strings.Contains(login, "?") {
+		sep = "&"
+	}
+	return login + sep + "rd=" + url.QueryEscape(rd)
+}
+
+// authorize checks the request has a valid session (see authenticate) which, if we have a policy, may access
+// the original request, as described by the headers with the given prefix (see originalRequest).
+// Returns the session claims & http.StatusOK if so, otherwise the status to deny the request with.
+func (s *server) authorize(r *http.Request, headers string) (*JWTClaim, int) {
+	jwt, status := s.authenticate(r)
+	if status != http.StatusOK {
+		return nil, status
 	}
 
-	_, span := tracer.Start(r.Context(), "access-approved")
+	_, span := tracer.Start(r.Context(), "access-check")
 	defer span.End()
-	span.AddEvent("Access approved")
 	span.SetAttributes(attribute.String("user", jwt.Username))
 
-	w.Header().Set("Content-Type", "text/plain")
+	if s.policy != nil {
+		req, err := originalRequest(r, headers)
+		if err != nil {
+			log.Println("Invalid original request:", err)
+			return nil, http.StatusBadRequest
+		}
+		if !s.policy.Allowed(req, jwt) {
+			log.Println("Access denied:", jwt.Username, req.Method, req.Host, req.Path)
+			span.AddEvent("Access denied by policy")
+			span.SetAttributes(attribute.String("path", req.Path))
+			return nil, http.StatusForbidden
+		}
+	}
+
+	span.AddEvent("Access approved")
+	return jwt, http.StatusOK
+}
+
+// authenticate returns the claims of the request's session; a JWT in the cookie or as a bearer token
+// (see sessionToken) or, if enabled and there's no JWT, Basic auth credentials (see basicAuthenticate).
+// Returns http.StatusUnauthorized if there's no valid session.
+func (s *server) authenticate(r *http.Request) (*JWTClaim, int) {
+	token := s.sessionToken(r)
+	if token == "" {
+		if s.basicAuth != BasicAuthOff && isBasicAuth(r) {
+			return s.basicAuthenticate(r)
+		}
+		log.Println("No session token found")
+		return nil, http.StatusUnauthorized
+	}
+
+	jwt, err := s.validateSession(token)
+	if err != nil {
+		log.Println("Invalid JWT:", err)
+		return nil, http.StatusUnauthorized
+	}
+	return jwt, http.StatusOK
+}
+
+// Headers proxies describe the original request with, as a prefix to Uri, Method & Host.
+// We only read the headers the proxy in front of each endpoint sets (overwriting anything the client
+// sent), since clients could otherwise pick which policy rules apply to them.
+const (
+	// nginx's auth_request, configured with proxy_set_header X-Original-URI etc. (see README)
+	originalHeaders = "X-Original-"
+
+	// Traefik's forwardAuth & Caddy's forward_auth, and our ext_authz service (see checkRequestToHTTP)
+	forwardedHeaders = "X-Forwarded-"
+)
+
+// originalRequest returns the request the proxy is asking us to authorize, from the headers with the given
+// prefix (see originalHeaders & forwardedHeaders). Without them we authorize the check request itself.
+func originalRequest(r *http.Request, prefix string) (*policyRequest, error) {
+	uri := r.Header.Get(prefix + "Uri")
+	if uri == "" {
+		uri = r.URL.RequestURI()
+	}
+	p, err := cleanRequestPath(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	method := r.Header.Get(prefix + "Method")
+	if method == "" {
+		method = r.Method
+	}
+
+	host := r.Header.Get(prefix + "Host")
+	if host == "" {
+		host = r.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return &policyRequest{Host: host, Method: method, Path: p}, nil
+}
+
+// setIdentityHeaders tells the proxy who the user is, so it can pass this on to the protected
+// service (eg. with nginx's auth_request_set). Headers configured as "" aren't set.
+func (s *server) setIdentityHeaders(h http.Header, claims *JWTClaim) {
+	if s.userHeader != "" {
+		h.Set(s.userHeader, claims.Username)
+	}
+	if s.groupsHeader != "" && len(claims.Groups) > 0 {
+		h.Set(s.groupsHeader, strings.Join(claims.Groups, ","))
+	}
+	if s.expiresHeader != "" {
+		h.Set(s.expiresHeader, time.Unix(claims.ExpiresAt, 0).UTC().Format(time.RFC3339))
+	}
+}
+
+// validateSession checks a session JWT is validly signed, unexpired & not revoked, returning its claims.
+func (s *server) validateSession(token string) (*JWTClaim, error) {
+	claims, err := validateSignedJWT(s.jwtKeys.Keys(), token, sessionAudience)
+	if err != nil {
+		return nil, err
+	}
+	revoked, err := s.revocations.Revoked(claims)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check revocation: %w", err)
+	} else if revoked {
+		return nil, fmt.Errorf("session revoked")
+	}
+	return claims, nil
+}
+
+// logoutCSRFPrefix prefixes the session ID a logout page's CSRF token is for, so it can't be mistaken for a login's.
+const logoutCSRFPrefix = "logout:"
+
+// authLogout is the handler for the /auth/logout endpoint.
+// GET asks the user to confirm, as other sites can make browsers GET (or POST to) any URL, so
+// only a POST with a CSRF token for the user's session logs them out (see logoutPost).
+func (s *server) authLogout(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.logoutGet(w, r)
+	case http.MethodPost:
+		s.logoutPost(w, r)
+	default:
+		log.Println("Method not allowed", r.Method)
+		writeError(w, "No", http.StatusMethodNotAllowed)
+	}
+}
+
+// logoutGet renders the logout page, with a CSRF token for the session. Without a session there's
+// nothing to log out of, so we go straight to the login page.
+func (s *server) logoutGet(w http.ResponseWriter, r *http.Request) {
+	claims, err := s.validateSession(s.sessionToken(r))
+	if err != nil {
+		s.sendLoggedOut(w)
+		return
+	}
+
+	csrf, err := signClaims(NewHMACJWTKey("", s.csrfKey), csrfAudience, &JWTClaim{Username: logoutCSRFPrefix + claims.Id}, s.cacheTTL)
+	if err != nil {
+		log.Println("Error generating logout JWT:", err)
+		s.writeErrorPage(w, msgInternalError, http.StatusInternalServerError)
+		return
+	}
+	s.renderTemplate(w, logoutTemplate, &logoutPage{LogoutURL: s.authLogoutURL, CSRF: csrf, Username: claims.Username}, http.StatusOK)
+}
+
+// logoutPost revokes the session (if any, from the cookie or a bearer token; see sessionToken) so the JWT can't be
+// used again, clears the cookie & redirects to the login page. Sessions from the cookie need the CSRF token from
+// the logout page; bearer tokens don't, as browsers don't send them by themselves. Nor do remembered Basic auth
+// credentials (see basicAuthenticate), which are for clients that aren't browsers.
+func (s *server) logoutPost(w http.ResponseWriter, r *http.Request) {
+	var claims *JWTClaim
+	if token := s.sessionToken(r); token != "" {
+		c, err := s.validateSession(token)
+		if err == nil && token != bearerToken(r) {
+			csrf, csrfErr := validateJWT(s.csrfKey, r.PostFormValue("csrf"))
+			if csrfErr != nil || csrf.Username != logoutCSRFPrefix+c.Id {
+				log.Println("Invalid logout CSRF token:", c.Username)
+				s.writeErrorPage(w, "This page has expired, please try logging out again", http.StatusForbidden)
+				return
+			}
+		}
+		if err == nil {
+			claims = c
+		}
+	} else if s.basicAuth != BasicAuthOff && isBasicAuth(r) {
+		claims, _ = s.basicSessions.Get(s.basicSessionKey(r))
+	}
+
+	if claims != nil {
+		err := s.revocations.Revoke(claims.Id, time.Unix(claims.ExpiresAt, 0))
+		if err != nil {
+			// the cookie is still cleared, but the JWT remains valid until it expires
+			log.Println("Error revoking session:", err)
+		} else {
+			log.Println("User logged out:", claims.Username)
+		}
+
+		_, span := tracer.Start(r.Context(), "logout")
+		span.AddEvent("Session revoked")
+		span.SetAttributes(attribute.String("user", claims.Username))
+		span.End()
+	}
+	s.sendLoggedOut(w)
+}
+
+// sendLoggedOut clears the cookie & redirects to the login page.
+func (s *server) sendLoggedOut(w http.ResponseWriter) {
+	clearCookie(w, s.cookieName, s.cookieDomain)
+	w.Header().Set("Location", s.authLoginURL)
+	w.WriteHeader(http.StatusFound)
+}
+
+// jwks is the handler for the /.well-known/jwks.json endpoint.
+// Returns the public keys our JWTs may be signed with, so backends can verify them without being
+// able to forge them. Shared secret (HS256) keys are never published.
+func (s *server) jwks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		log.Println("Method not allowed", r.Method)
+		writeError(w, "No", http.StatusMethodNotAllowed)
+		return
+	}
+
+	keys := []map[string]string{}
+	for _, k := range s.jwtKeys.Keys() {
+		if jwk := k.JWK(); jwk != nil {
+			keys = append(keys, jwk)
+		}
+	}
+
+	data, err := json.Marshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		log.Println("Error encoding JWKS:", err)
+		writeError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Welcome"))
+	w.Write(data)
 }
 
 // authLogin is the handler for the /auth/login endpoint.
@@ -180,26 +601,48 @@ func (s *server) authLogin(w http.ResponseWriter, r *http.Request) {
 		s.loginGet(w, r)
 		return
 	} else if r.Method == http.MethodPost {
-		if time.Now().Unix() < s.lastLogin+s.secondsBetweenLogins {
-			w.Header().Set("Content-Type", "text/plain")
-			w.WriteHeader(http.StatusTooManyRequests)
+		if !s.allowLogin(r, r.PostFormValue("user")) {
+			s.sendLoginFailure(w, r, failureRateLimited, time.Duration(s.secondsBetweenLogins)*time.Second)
 			return
 		}
-		s.lastLogin = time.Now().Unix()
 
 		s.loginPost(w, r)
 		return
 	}
 	log.Println("Method not allowed", r.Method)
-	writeError(w, "No", http.StatusMethodNotAllowed)
+	s.writeErrorPage(w, "No", http.StatusMethodNotAllowed)
+}
+
+// allowLogin returns if a login attempt is within our rate limit, taking a token from
+// the bucket(s) for the client IP and/or username as configured.
+func (s *server) allowLogin(r *http.Request, user string) bool {
+	now := time.Now()
+	ip := clientIP(r, s.clientIPHeader)
+
+	allowed := true
+	switch s.rateLimitKey {
+	case RateLimitByIP:
+		allowed = s.limiter.allow("ip:"+ip, now)
+	case RateLimitByUser:
+		allowed = s.limiter.allow("user:"+user, now)
+	case RateLimitByIPAndUser:
+		allowed = s.limiter.allow("ip:"+ip, now) && s.limiter.allow("user:"+user, now)
+	}
+	if !allowed {
+		log.Println("Login rate limited:", user, ip)
+		_, span := tracer.Start(r.Context(), "login-rate-limited")
+		span.AddEvent("Access denied")
+		span.SetAttributes(attribute.String("user", user), attribute.String("client.ip", ip))
+		span.End()
+	}
+	return allowed
 }
 
 // loginPost handles the POST request for the login form.
 // - reads sent values
 // - validates the CSRF token
 // - checks if the CSRF token has already been used
-// - validates the username
-// - validates the TOTP
+// - checks the username & code (see checkLogin)
 // - generates a JWT
 // - sets the JWT cookie
 // - redirects to the configured URL
@@ -208,16 +651,16 @@ func (s *server) loginPost(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		log.Println("Error parsing form:", err)
-		s.sendLoginPage(w, r, http.StatusBadRequest)
+		s.sendLoginFailure(w, r, failureInvalidRequest, 0)
 		return
 	}
 
 	// read and validate our fields
 	csrf := r.Form.Get("csrf")
-	_, err = validateJWT(s.csrfKey, csrf)
+	csrfClaims, err := validateJWT(s.csrfKey, csrf)
 	if err != nil {
 		log.Println("Invalid CSRF token:", err)
-		s.sendLoginPage(w, r, http.StatusUnauthorized)
+		s.sendLoginFailure(w, r, failureFormExpired, 0)
 		return
 	}
 
@@ -225,89 +668,300 @@ func (s *server) loginPost(w http.ResponseWriter, r *http.Request) {
 	_, ok := s.sessions.Get(csrf)
 	if ok {
 		log.Println("CSRF token already used")
-		s.sendLoginPage(w, r, http.StatusUnauthorized)
+		s.sendLoginFailure(w, r, failureFormExpired, 0)
 		return
 	}
 
 	// remember this token for the session length (after this the JWT will expire anyways)
 	s.sessions.Add(csrf, true)
 
-	user := r.Form.Get("user")
-	if !s.re.MatchString(user) {
-		log.Println("Invalid username:", user)
-		s.sendLoginPage(w, r, http.StatusUnauthorized)
+	userObj, reason, wait := s.checkLogin(r, r.Form.Get("user"), r.Form.Get("token"), false)
+	if reason != "" {
+		s.sendLoginFailure(w, r, reason, wait)
 		return
 	}
 
-	token := strings.Replace(r.Form.Get("token"), " ", "", -1)
-	if !s.re.MatchString(token) {
-		log.Println("Invalid token:", token)
-		s.sendLoginPage(w, r, http.StatusUnauthorized)
+	// login successful -- generate JWT
+	_, span := tracer.Start(r.Context(), "login-success")
+	defer span.End()
+	span.AddEvent("Access approved")
+	span.SetAttributes(attribute.String("user", userObj.Username))
+
+	jwtKey, _, err := newSessionJWT(s.jwtKeys.Active(), userObj, s.jwtSessionTTL)
+	if err != nil {
+		log.Println("Error generating JWT:", err)
+		s.writeErrorPage(w, msgInternalError, http.StatusInternalServerError)
 		return
 	}
+	log.Println("User logged in:", userObj.Username)
+	redirect := s.redirect
+	if csrfClaims.ReturnTo != "" {
+		redirect = csrfClaims.ReturnTo
+	}
+	w.Header().Set("Location", redirect)
+	writeCookie(w, s.cookieName, s.cookieDomain, jwtKey)
+	w.WriteHeader(http.StatusFound)
+}
+
+// checkLogin checks a username & code (or backup code), as sent to any of our login endpoints.
+// - validates the username
+// - checks the user / client isn't locked out for too many failures
+// - if withPassword, checks the token starts with the user's password (see checkPassword)
+// - validates the TOTP (or a backup code, which is then used up)
+// - checks the TOTP hasn't already been used
+//
+// Returns the user if the login is valid, otherwise why not (and how long to wait, if locked out).
+func (s *server) checkLogin(r *http.Request, user, token string, withPassword bool) (*User, loginFailure, time.Duration) {
+	if !s.re.MatchString(user) {
+		log.Println("Invalid username:", user)
+		return nil, failureInvalidCode, 0
+	}
+
+	if !withPassword {
+		token = strings.Replace(token, " ", "", -1)
+		// backup codes may be typed with their dash
+		if !s.re.MatchString(strings.Replace(token, "-", "", -1)) {
+			log.Println("Invalid token:", token)
+			return nil, failureInvalidCode, 0
+		}
+	}
+
+	// refuse to check codes while the user or client is locked out
+	ip := s.lockoutIP(r)
+	if wait := s.lockedOut(user, ip); wait > 0 {
+		log.Println("Login locked out:", user, ip, "for", wait)
+		_, span := tracer.Start(r.Context(), "login-locked-out")
+		span.AddEvent("Access denied")
+		span.SetAttributes(
+			attribute.String("user", user),
+			attribute.String("client.ip", ip),
+			attribute.Float64("lockout.remaining_seconds", wait.Seconds()),
+		)
+		span.End()
+		return nil, failureLockedOut, wait
+	}
 
 	// load the user from the store
 	userObj, err := s.store.User(user)
 	if err != nil {
 		log.Println("Error loading user:", err)
-		s.sendLoginPage(w, r, http.StatusUnauthorized)
-		return
+		s.loginFailed(r.Context(), user, ip)
+		return nil, failureInvalidCode, 0
+	}
+
+	if userObj.Disabled {
+		// treated like any other failure, so we don't reveal the account exists
+		log.Println("User disabled:", userObj.Username)
+		s.loginFailed(r.Context(), user, ip)
+		return nil, failureInvalidCode, 0
+	}
+
+	if withPassword {
+		code, ok := checkPassword(userObj, token)
+		if !ok {
+			log.Println("Invalid password:", userObj.Username)
+			s.loginFailed(r.Context(), user, ip)
+			return nil, failureInvalidCode, 0
+		}
+		token = code
 	}
 
 	// validate the TOTP
-	if !validateTOTP(userObj.Secret, token) {
-		log.Println("Invalid TOTP")
-		s.sendLoginPage(w, r, http.StatusUnauthorized)
-		return
+	step, ok := validateTOTP(userObj, token, time.Now())
+	if ok {
+		// check the code hasn't been used before
+		ok, err = s.replay.Accept(userObj.Username, step)
+		if err != nil {
+			log.Println("Error checking TOTP replay:", err)
+			return nil, failureInternal, 0
+		} else if !ok {
+			log.Println("TOTP already used:", userObj.Username)
+			s.loginFailed(r.Context(), user, ip)
+			return nil, failureInvalidCode, 0
+		}
+	} else {
+		// not a valid TOTP, but it might be a backup code
+		ok, err = s.useBackupCode(userObj.Username, token)
+		if err != nil {
+			log.Println("Error using backup code:", err)
+		}
+		if !ok {
+			log.Println("Invalid TOTP")
+			s.loginFailed(r.Context(), user, ip)
+			return nil, failureInvalidCode, 0
+		}
+		log.Println("Backup code used:", userObj.Username)
+	}
+	s.userLockout.reset(user)
+	if ip != "" {
+		s.ipLockout.reset(ip)
 	}
 
-	// login successful -- generate JWT
-	_, span := tracer.Start(r.Context(), "login-success")
-	defer span.End()
-	span.AddEvent("Access approved")
-	span.SetAttributes(attribute.String("user", userObj.Username))
+	return userObj, "", 0
+}
 
-	jwtKey, err := newJWT(s.jwtKey, user, s.jwtSessionTTL)
-	log.Println("User logged in:", userObj.Username)
-	w.Header().Set("Location", s.redirect)
-	writeCookie(w, s.cookieName, jwtKey)
-	w.WriteHeader(http.StatusFound)
+// useBackupCode checks the code against the user's backup codes, removing it if it matches so it can't be used again.
+// Requires WritableStorage. Storage implementing BackupCodeStorage uses up codes atomically, so it's safe for
+// replicas sharing it; otherwise consumption is serialised within this server.
+func (s *server) useBackupCode(username, code string) (bool, error) {
+	ws, ok := s.store.(WritableStorage)
+	if !ok {
+		return false, nil // we can't use up codes, so we can't accept them
+	}
+
+	if bs, ok := s.store.(BackupCodeStorage); ok {
+		u, err := ws.User(username)
+		if err != nil {
+			return false, err
+		}
+		i := matchBackupCode(u.BackupCodes, code)
+		if i < 0 {
+			return false, nil
+		}
+		return bs.UseBackupCode(username, u.BackupCodes[i])
+	}
+
+	s.backupLock.Lock()
+	defer s.backupLock.Unlock()
+
+	// reload, in case a code was used while we waited for the lock
+	u, err := ws.User(username)
+	if err != nil {
+		return false, err
+	}
+	i := matchBackupCode(u.BackupCodes, code)
+	if i < 0 {
+		return false, nil
+	}
+	u.BackupCodes = append(u.BackupCodes[:i], u.BackupCodes[i+1:]...)
+	err = ws.UpdateUser(u)
+	return err == nil, err
+}
+
+// lockoutIP returns the client IP to count failed logins against, or "" if we can't tell clients apart.
+// Without a client IP header we may be behind a proxy, where every client has the proxy's address, so
+// locking it out would lock out everyone. ext_authz requests have the client's address from Envoy.
+func (s *server) lockoutIP(r *http.Request) string {
+	if s.clientIPHeader == "" && r.Context().Value(clientAddressKey{}) == nil {
+		return ""
+	}
+	return clientIP(r, s.clientIPHeader)
+}
+
+// lockedOut returns how long until the user and client (if known, see lockoutIP) may attempt a login
+// (zero if they may now).
+func (s *server) lockedOut(user, ip string) time.Duration {
+	now := time.Now()
+	wait := s.userLockout.remaining(user, now)
+	if ip == "" {
+		return wait
+	}
+	if ipWait := s.ipLockout.remaining(ip, now); ipWait > wait {
+		wait = ipWait
+	}
+	return wait
+}
+
+// loginFailed counts a failed login against the user & client (if known, see lockoutIP), logging & tracing any lockout.
+func (s *server) loginFailed(ctx context.Context, user, ip string) {
+	now := time.Now()
+	userFailures, userWait := s.userLockout.fail(user, now)
+	ipFailures, ipWait := 0, time.Duration(0)
+	if ip != "" {
+		ipFailures, ipWait = s.ipLockout.fail(ip, now)
+	}
+
+	_, span := tracer.Start(ctx, "login-failure")
+	defer span.End()
+	span.AddEvent("Access denied")
+	span.SetAttributes(
+		attribute.String("user", user),
+		attribute.String("client.ip", ip),
+		attribute.Int("user.failures", userFailures),
+		attribute.Int("client.failures", ipFailures),
+	)
+
+	if userWait > 0 {
+		log.Println("User locked out:", user, "failures:", userFailures, "for", userWait)
+		span.AddEvent("User locked out", trace.WithAttributes(attribute.Float64("lockout.seconds", userWait.Seconds())))
+	}
+	if ipWait > 0 {
+		log.Println("Client locked out:", ip, "failures:", ipFailures, "for", ipWait)
+		span.AddEvent("Client locked out", trace.WithAttributes(attribute.Float64("lockout.seconds", ipWait.Seconds())))
+	}
 }
 
 // loginGet handles the GET request for the login form.
 // - generates a session / CSRF token
 // - returns the login form with the CSRF token
 func (s *server) loginGet(w http.ResponseWriter, r *http.Request) {
-	s.sendLoginPage(w, r, http.StatusOK)
+	s.sendLoginPage(w, r, http.StatusOK, &loginPage{})
 }
 
-func (s *server) sendLoginPage(w http.ResponseWriter, r *http.Request, statusOnSend int) {
+// sendLoginPage renders the login page with a new CSRF token, carrying where to send the user after login.
+func (s *server) sendLoginPage(w http.ResponseWriter, r *http.Request, statusOnSend int, page *loginPage) {
 	// generate a new session
 	rng, err := randBytes(64)
 	if err != nil {
 		log.Println("Error generating random bytes:", err)
-		writeError(w, "Internal server error", http.StatusInternalServerError)
+		s.writeErrorPage(w, msgInternalError, http.StatusInternalServerError)
 		return
 	}
 	sessID := fmt.Sprintf("%d-%x", time.Now().Unix(), rng)
 
-	// generate a session token
+	// generate a session token, carrying where to send the user after login
 	// ie. this is how long we're willing to accept the CSRF token back
-	sessTkn, err := newJWT(s.csrfKey, sessID, s.cacheTTL)
+	page.ReturnTo = s.returnTo(r)
+	sessTkn, err := signClaims(NewHMACJWTKey("", s.csrfKey), csrfAudience, &JWTClaim{Username: sessID, ReturnTo: page.ReturnTo}, s.cacheTTL)
 	if err != nil {
 		log.Println("Error generating session JWT:", err)
-		writeError(w, "Internal server error", http.StatusInternalServerError)
+		s.writeErrorPage(w, msgInternalError, http.StatusInternalServerError)
 		return
 	}
 
 	// return the login form with the CSRF token
-	writeIndex(w, s.authLoginURL, sessTkn, statusOnSend)
+	page.LoginURL = s.authLoginURL
+	page.CSRF = sessTkn
+	if r.Method == http.MethodPost {
+		page.Username = r.PostFormValue("user")
+	}
+	s.renderTemplate(w, loginTemplate, page, statusOnSend)
 }
 
-// writeCookie writes a cookie to the response.
-func writeCookie(w http.ResponseWriter, name, value string) {
+// returnTo returns where to send the user after they log in, or "" for the default redirect.
+// When re-sending the login page after a failed POST we keep what the previous CSRF token carried.
+func (s *server) returnTo(r *http.Request) string {
+	if r.Method == http.MethodPost {
+		claims, err := validateJWT(s.csrfKey, r.PostFormValue("csrf"))
+		if err != nil {
+			return ""
+		}
+		return claims.ReturnTo
+	}
+	return returnURL(r, s.redirectAllowList)
+}
+
+// clientIP returns the IP of the client making the request. If a header is given (eg. X-Real-IP set
+// by a reverse proxy) and present we use the first address in it, otherwise the remote address.
+func clientIP(r *http.Request, header string) string {
+	if header != "" {
+		if value := r.Header.Get(header); value != "" {
+			first, _, _ := strings.Cut(value, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// writeCookie writes a cookie to the response. If domain is set the cookie is also sent to its subdomains.
+func writeCookie(w http.ResponseWriter, name, domain, value string) {
 	cookie := http.Cookie{}
 	cookie.Name = name
+	cookie.Domain = domain
 	cookie.Value = value
 	cookie.Secure = true
 	cookie.HttpOnly = false
@@ -315,17 +969,16 @@ func writeCookie(w http.ResponseWriter, name, value string) {
 	http.SetCookie(w, &cookie)
 }
 
-// writeIndex writes the login form to the response.
-func writeIndex(w http.ResponseWriter, loginURL, csrf string, status int) {
-	w.Header().Set("Content-Type", "text/html")
-	w.WriteHeader(status)
-	w.Write([]byte(fmt.Sprintf(`<html><head><title>Please Log In</title></head>
-<body><form action="%s" method="POST">
-<input placeholder="username" type="text" name="user">
-<input placeholder="code" type="text" name="token">
-<input type="hidden" name="csrf" value="%s">
-<input type="submit" value="Submit">
-</form></body></html>`, loginURL, csrf)))
+// clearCookie tells the client to delete a cookie.
+func clearCookie(w http.ResponseWriter, name, domain string) {
+	cookie := http.Cookie{}
+	cookie.Name = name
+	cookie.Domain = domain
+	cookie.Value = ""
+	cookie.Secure = true
+	cookie.Path = "/"
+	cookie.MaxAge = -1
+	http.SetCookie(w, &cookie)
 }
 
 // writeError writes an error message to the response.
@@ -1,6 +1,9 @@
 package totp
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 type WebOption func(*server)
 
@@ -13,12 +16,36 @@ func WithCSRFKey(key []byte) WebOption {
 	}
 }
 
-// WithJWTKey sets the JWT key for the server, used to sign JWT tokens.
-// If this is changed existing tokens will be invalid.
-// (Required).
+// WithJWTKey sets the JWT key for the server, used to sign JWT tokens (HS256).
+// If this is changed existing tokens will be invalid (see WithJWTKeyring to rotate keys).
+// (Required, unless WithJWTSigningKey or WithJWTKeyring is given).
 func WithJWTKey(key []byte) WebOption {
+	return WithJWTSigningKey(NewHMACJWTKey("", key))
+}
+
+// WithJWTSigningKey sets the key used to sign JWT tokens, eg. an RS256/ES256/EdDSA private key
+// (see ParsePEMJWTKey). The public part of asymmetric keys is published on the JWKS URL.
+// Replaces any key(s) given by WithJWTKey or WithJWTKeyring.
+func WithJWTSigningKey(key *JWTKey) WebOption {
+	return func(s *server) {
+		s.jwtKeys = &JWTKeyring{active: key, keys: []*JWTKey{key}}
+	}
+}
+
+// WithJWTKeyring sets the keys used to sign & verify JWT tokens; new tokens are signed with the
+// active key, tokens signed with any key in the ring are accepted.
+// Replaces any key given by WithJWTKey or WithJWTSigningKey.
+func WithJWTKeyring(keys *JWTKeyring) WebOption {
+	return func(s *server) {
+		s.jwtKeys = keys
+	}
+}
+
+// WithJWKSURL sets the URL the JSON Web Key Set (our public JWT keys) is served on.
+// An empty string disables the endpoint.
+func WithJWKSURL(url string) WebOption {
 	return func(s *server) {
-		s.jwtKey = key
+		s.jwksURL = url
 	}
 }
 
@@ -52,7 +79,7 @@ func WithJWTSessionTTL(ttl time.Duration) WebOption {
 	}
 }
 
-// WithRedirect sets the URL to redirect to after a successful login
+// WithRedirect sets the URL to redirect to after a successful login, if we don't know where the user was going
 func WithRedirect(redirect string) WebOption {
 	return func(s *server) {
 		s.redirect = redirect
@@ -73,6 +100,14 @@ func WithAuthLoginURL(url string) WebOption {
 	}
 }
 
+// WithAuthLogoutURL sets the URL that logs a user out, revoking their session.
+// An empty string disables the endpoint.
+func WithAuthLogoutURL(url string) WebOption {
+	return func(s *server) {
+		s.authLogoutURL = url
+	}
+}
+
 // WithStorage sets the storage backend for the server (required)
 func WithStorage(store Storage) WebOption {
 	return func(s *server) {
@@ -80,6 +115,157 @@ func WithStorage(store Storage) WebOption {
 	}
 }
 
+// WithReplayStore sets where we remember which TOTP codes have been used (defaults to in memory).
+// Replicas should share a store, otherwise a code can be replayed against another replica.
+func WithReplayStore(store ReplayStore) WebOption {
+	return func(s *server) {
+		s.replay = store
+	}
+}
+
+// WithRevocationStore sets where we record revoked sessions (defaults to in memory).
+// Replicas should share a store, otherwise a session revoked on one replica is still valid on the others.
+func WithRevocationStore(store RevocationStore) WebOption {
+	return func(s *server) {
+		s.revocations = store
+	}
+}
+
+// WithIdentityHeaders sets the headers /auth/check writes with the user's name, groups (comma separated)
+// and session expiry (RFC 3339), for the proxy to pass on to the protected service. "" disables a header.
+func WithIdentityHeaders(user, groups, expires string) WebOption {
+	return func(s *server) {
+		s.userHeader = user
+		s.groupsHeader = groups
+		s.expiresHeader = expires
+	}
+}
+
+// WithPolicy sets which users may access which paths (see Policy). Without a policy
+// any logged in user may access everything.
+func WithPolicy(policy *Policy) WebOption {
+	return func(s *server) {
+		s.policy = policy
+	}
+}
+
+// WithRedirectAllowList sets where users may be sent back to after login, as host[/path prefix] (eg. *.example.com)
+// or /path prefix entries. By default only relative URLs (on our host) are allowed.
+func WithRedirectAllowList(entries ...string) WebOption {
+	return func(s *server) {
+		s.redirectAllowList = entries
+	}
+}
+
+// WithAuthForwardURL sets the URL for Traefik forwardAuth / Caddy forward_auth, which redirects users
+// that aren't logged in to the login page. An empty string disables the endpoint.
+func WithAuthForwardURL(url string) WebOption {
+	return func(s *server) {
+		s.authForwardURL = url
+	}
+}
+
+// WithLoginRedirectURL sets the (usually absolute) login URL the forward auth endpoint sends users to,
+// eg. https://auth.example.com/auth/login. Defaults to the login URL, ie. on the same host as the app.
+func WithLoginRedirectURL(url string) WebOption {
+	return func(s *server) {
+		s.loginRedirectURL = url
+	}
+}
+
+// WithCookieDomain sets the domain of the session cookie, eg. example.com to share the session
+// with all subdomains. Defaults to only the host that served the login page.
+func WithCookieDomain(domain string) WebOption {
+	return func(s *server) {
+		s.cookieDomain = domain
+	}
+}
+
+// WithGRPCPort sets the port to serve the Envoy ext_authz gRPC service on (0, the default, disables it).
+func WithGRPCPort(port int) WebOption {
+	return func(s *server) {
+		s.grpcPort = port
+	}
+}
+
+// WithTemplateDir sets a directory of templates (login.html and/or error.html, see html/template)
+// to use instead of the built in pages.
+func WithTemplateDir(dir string) WebOption {
+	return func(s *server) {
+		s.templateDir = dir
+	}
+}
+
+// WithInviteKey sets the key invitations are signed with (see NewInvitation), enabling self-service enrollment.
+// Requires WritableStorage.
+func WithInviteKey(key []byte) WebOption {
+	return func(s *server) {
+		s.inviteKey = key
+	}
+}
+
+// WithAuthAPILoginURL sets the URL of the JSON login API, for non-browser clients.
+// An empty string disables the endpoint.
+func WithAuthAPILoginURL(url string) WebOption {
+	return func(s *server) {
+		s.authAPILoginURL = url
+	}
+}
+
+// WithAuthEnrollURL sets the URL invited users enroll at.
+func WithAuthEnrollURL(url string) WebOption {
+	return func(s *server) {
+		s.authEnrollURL = url
+	}
+}
+
+// WithIssuer sets the issuer name shown in authenticator apps for users that enroll themselves.
+func WithIssuer(issuer string) WebOption {
+	return func(s *server) {
+		s.issuer = issuer
+	}
+}
+
+// WithAdminURL sets the URL the admin API is served under (default /admin/api/users).
+func WithAdminURL(url string) WebOption {
+	return func(s *server) {
+		s.adminURL = strings.TrimSuffix(url, "/")
+	}
+}
+
+// WithAdminToken sets a bearer token that grants access to the admin API.
+// The admin API is only served if an admin token and/or group is set, and requires WritableStorage.
+func WithAdminToken(token string) WebOption {
+	return func(s *server) {
+		s.adminToken = token
+	}
+}
+
+// WithAdminGroup sets a group whose (logged in) users may use the admin API.
+func WithAdminGroup(group string) WebOption {
+	return func(s *server) {
+		s.adminGroup = group
+	}
+}
+
+// WithTokenPrecedence sets where sessions are read from when authorizing requests; the cookie
+// and/or an Authorization: Bearer header, and which is preferred (default TokenCookieFirst).
+func WithTokenPrecedence(p TokenPrecedence) WebOption {
+	return func(s *server) {
+		s.tokenPrecedence = p
+	}
+}
+
+// WithBasicAuth sets whether /auth/check accepts HTTP Basic auth credentials (default BasicAuthOff),
+// remembering accepted credentials for ttl so clients can send them again. Credentials are remembered for the
+// client IP that sent them, so behind a proxy also set WithClientIPHeader.
+func WithBasicAuth(mode BasicAuthMode, ttl time.Duration) WebOption {
+	return func(s *server) {
+		s.basicAuth = mode
+		s.basicAuthTTL = ttl
+	}
+}
+
 // WithCookieName sets the name of the cookie used to store the JWT token
 func WithCookieName(name string) WebOption {
 	return func(s *server) {
@@ -88,13 +274,36 @@ func WithCookieName(name string) WebOption {
 }
 
 // WithSecondsBetweenLogins sets the minimum time between logins.
-// That is, we ratelimit attempts to POST to /auth/login
+// That is, we ratelimit attempts to POST to /auth/login; each client IP and/or username (see WithRateLimitKey)
+// may make a burst of attempts (see WithLoginBurst) then one attempt every this many seconds.
+// Zero disables rate limiting.
 func WithSecondsBetweenLogins(seconds int64) WebOption {
 	return func(s *server) {
 		s.secondsBetweenLogins = seconds
 	}
 }
 
+// WithLoginBurst sets how many login attempts may be made at once before rate limiting kicks in.
+func WithLoginBurst(burst int) WebOption {
+	return func(s *server) {
+		s.loginBurst = burst
+	}
+}
+
+// WithRateLimitKey sets what login attempts are rate limited by; client IP (the default), username or both.
+func WithRateLimitKey(key RateLimitKey) WebOption {
+	return func(s *server) {
+		s.rateLimitKey = key
+	}
+}
+
+// WithRateLimitCacheSize sets how many client IPs / usernames we track login rate limits for.
+func WithRateLimitCacheSize(size int) WebOption {
+	return func(s *server) {
+		s.rateLimitCacheSize = size
+	}
+}
+
 // WithHTTPReadTimeout sets the read timeout for the HTTP server
 func WithHTTPReadTimeout(timeout time.Duration) WebOption {
 	return func(s *server) {
@@ -108,3 +317,45 @@ func WithHTTPWriteTimeout(timeout time.Duration) WebOption {
 		s.httpWriteTimeout = timeout
 	}
 }
+
+// WithClientIPHeader sets a header to read the client IP from (eg. X-Real-IP), for when we're behind
+// a reverse proxy. Only set this if the proxy always sets (or overwrites) the header, since clients
+// can otherwise send whatever they like. If unset we use the remote address of the connection, and
+// (as that may be the proxy's) don't lock out client IPs, only users.
+func WithClientIPHeader(header string) WebOption {
+	return func(s *server) {
+		s.clientIPHeader = header
+	}
+}
+
+// WithLockoutThreshold sets how many failed logins a user or client IP may make before they are
+// temporarily locked out. Zero disables lockouts.
+func WithLockoutThreshold(failures int) WebOption {
+	return func(s *server) {
+		s.lockoutThreshold = failures
+	}
+}
+
+// WithLockoutDelay sets how long the first lockout lasts. Each further failure doubles the
+// lockout, up to max.
+func WithLockoutDelay(base, max time.Duration) WebOption {
+	return func(s *server) {
+		s.lockoutBaseDelay = base
+		s.lockoutMaxDelay = max
+	}
+}
+
+// WithLockoutReset sets how long a user or client IP must go without a failed login before
+// their failures are forgotten.
+func WithLockoutReset(reset time.Duration) WebOption {
+	return func(s *server) {
+		s.lockoutReset = reset
+	}
+}
+
+// WithLockoutCacheSize sets how many users & client IPs we track failures for (each).
+func WithLockoutCacheSize(size int) WebOption {
+	return func(s *server) {
+		s.lockoutCacheSize = size
+	}
+}
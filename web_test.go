@@ -0,0 +1,545 @@
+package totp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestServer builds a server with canned users (see NewDebugStorage) & test keys.
+func newTestServer(t *testing.T, opts ...WebOption) *server {
+	opts = append([]WebOption{
+		WithCSRFKey([]byte("test-csrf-key")),
+		WithJWTKey([]byte("test-jwt-key")),
+		WithStorage(NewDebugStorage()),
+	}, opts...)
+	s, err := buildServer(opts...)
+	assert.Nil(t, err)
+	return s
+}
+
+// postLogin POSTs the login form from the given client address.
+func postLogin(h http.Handler, remoteAddr, user, token string) *httptest.ResponseRecorder {
+	form := url.Values{"user": {user}, "token": {token}, "csrf": {"not-valid"}}
+	req := httptest.NewRequest(http.MethodPost, "/auth/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// loginWithCSRF POSTs the login form with a valid CSRF token.
+func loginWithCSRF(t *testing.T, s *server, user, token string) *httptest.ResponseRecorder {
+	csrf, err := newJWT(s.csrfKey, "test-session", time.Minute)
+	assert.Nil(t, err)
+
+	form := url.Values{"user": {user}, "token": {token}, "csrf": {csrf}}
+	req := httptest.NewRequest(http.MethodPost, s.authLoginURL, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	s.newHTTPHandler().ServeHTTP(w, req)
+	return w
+}
+
+func TestLoginBackupCode(t *testing.T) {
+	file, err := NewWritableFile(copyTestConfig(t))
+	assert.Nil(t, err)
+	sqlite := newTestSQLite(t)
+	for _, u := range []string{"mary", "james"} {
+		fu, err := file.User(u)
+		assert.Nil(t, err)
+		assert.Nil(t, sqlite.CreateUser(fu))
+	}
+
+	for name, store := range map[string]WritableStorage{"file": file, "sqlite": sqlite} {
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t, WithStorage(store))
+
+			codes, hashes, err := NewBackupCodes(2)
+			assert.Nil(t, err)
+			u, err := store.User("mary")
+			assert.Nil(t, err)
+			u.BackupCodes = hashes
+			assert.Nil(t, store.UpdateUser(u))
+
+			// a backup code logs us in ..
+			w := loginWithCSRF(t, s, "mary", codes[0])
+			assert.Equal(t, http.StatusFound, w.Code)
+
+			// .. once
+			w = loginWithCSRF(t, s, "mary", codes[0])
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+			// and is removed from storage
+			u, err = store.User("mary")
+			assert.Nil(t, err)
+			assert.Equal(t, hashes[1:], u.BackupCodes)
+
+			// not valid for other users
+			w = loginWithCSRF(t, s, "james", codes[1])
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+	}
+}
+
+func TestLoginRateLimit(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Key         RateLimitKey
+		ExpectTotal int
+	}{
+		{"by-ip", RateLimitByIP, 4},     // a burst each for two IPs
+		{"by-user", RateLimitByUser, 2}, // one burst shared by the user
+		{"both", RateLimitByIPAndUser, 2},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			s := newTestServer(t, WithRateLimitKey(c.Key), WithLoginBurst(2), WithSecondsBetweenLogins(3600))
+			h := s.newHTTPHandler()
+
+			// hammer the handler concurrently from two client IPs (run with -race)
+			var allowed int64
+			var wg sync.WaitGroup
+			for _, addr := range []string{"10.0.0.1:1000", "10.0.0.2:1000"} {
+				for i := 0; i < 10; i++ {
+					wg.Add(1)
+					go func(addr string) {
+						defer wg.Done()
+						w := postLogin(h, addr, "mary", "123456")
+						if w.Code != http.StatusTooManyRequests {
+							atomic.AddInt64(&allowed, 1)
+						}
+					}(addr)
+				}
+			}
+			wg.Wait()
+
+			assert.Equal(t, int64(c.ExpectTotal), allowed)
+		})
+	}
+}
+
+func TestBuildServerInvalidRateLimitKey(t *testing.T) {
+	_, err := buildServer(
+		WithCSRFKey([]byte("test-csrf-key")),
+		WithJWTKey([]byte("test-jwt-key")),
+		WithStorage(NewDebugStorage()),
+		WithRateLimitKey("nope"),
+	)
+	assert.NotNil(t, err)
+}
+
+func TestBuildServerInvalidJWTKey(t *testing.T) {
+	cases := []struct {
+		Name string
+		Opt  WebOption
+	}{
+		{"nil-secret", WithJWTKey(nil)},
+		{"empty-secret", WithJWTKey([]byte{})},
+		{"nil-key", WithJWTSigningKey(nil)},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			_, err := buildServer(
+				WithCSRFKey([]byte("test-csrf-key")),
+				c.Opt,
+				WithStorage(NewDebugStorage()),
+			)
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	key, err := ParsePEMJWTKey("", testPEMKeys(t)["EdDSA"])
+	assert.Nil(t, err)
+
+	cases := []struct {
+		Name       string
+		Opts       []WebOption
+		ExpectKeys int
+	}{
+		{"hmac-not-published", nil, 0},
+		{"public-key", []WebOption{WithJWTSigningKey(key)}, 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			s := newTestServer(t, c.Opts...)
+			w := httptest.NewRecorder()
+			s.newHTTPHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			result := struct {
+				Keys []map[string]string `json:"keys"`
+			}{}
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &result))
+			assert.Len(t, result.Keys, c.ExpectKeys)
+			if c.ExpectKeys > 0 {
+				assert.Equal(t, key.ID, result.Keys[0]["kid"])
+				assert.Equal(t, "OKP", result.Keys[0]["kty"])
+			}
+		})
+	}
+}
+
+func TestLogout(t *testing.T) {
+	s := newTestServer(t)
+	h := s.newHTTPHandler()
+
+	token, err := newSignedJWT(s.jwtKeys.Active(), "mary", time.Hour)
+	assert.Nil(t, err)
+	check := func() int {
+		req := httptest.NewRequest(http.MethodGet, s.authCheckURL, nil)
+		req.AddCookie(&http.Cookie{Name: s.cookieName, Value: token})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	logoutPage := func(token string) string {
+		req := httptest.NewRequest(http.MethodGet, s.authLogoutURL, nil)
+		req.AddCookie(&http.Cookie{Name: s.cookieName, Value: token})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		csrf := regexp.MustCompile(`name="csrf" value="([^"]+)"`).FindStringSubmatch(w.Body.String())
+		if !assert.Len(t, csrf, 2) {
+			return ""
+		}
+		return csrf[1]
+	}
+	logout := func(csrf string) *httptest.ResponseRecorder {
+		form := url.Values{"csrf": {csrf}}
+		req := httptest.NewRequest(http.MethodPost, s.authLogoutURL, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: s.cookieName, Value: token})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	assert.Equal(t, http.StatusOK, check())
+
+	// only asked to confirm, so other sites can't log users out ..
+	csrf := logoutPage(token)
+	assert.Equal(t, http.StatusOK, check())
+
+	// .. nor POST without the CSRF token for this session
+	assert.Equal(t, http.StatusForbidden, logout("").Code)
+	other, err := newSignedJWT(s.jwtKeys.Active(), "james", time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, logout(logoutPage(other)).Code)
+	assert.Equal(t, http.StatusOK, check())
+
+	w := logout(csrf)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, s.authLoginURL, w.Header().Get("Location"))
+	cookies := w.Result().Cookies()
+	if assert.Len(t, cookies, 1) {
+		assert.Equal(t, s.cookieName, cookies[0].Name)
+		assert.Equal(t, -1, cookies[0].MaxAge)
+	}
+
+	// the JWT is no longer accepted, even though it hasn't expired
+	assert.Equal(t, http.StatusUnauthorized, check())
+}
+
+func TestAuthCheckIdentityHeaders(t *testing.T) {
+	check := func(s *server, claims *JWTClaim) *httptest.ResponseRecorder {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("test-jwt-key"))
+		assert.Nil(t, err)
+		req := httptest.NewRequest(http.MethodGet, s.authCheckURL, nil)
+		req.AddCookie(&http.Cookie{Name: s.cookieName, Value: token})
+		w := httptest.NewRecorder()
+		s.newHTTPHandler().ServeHTTP(w, req)
+		return w
+	}
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	claims := &JWTClaim{Username: "mary", Groups: []string{"admin", "dev"}}
+	claims.ExpiresAt = expires.Unix()
+	claims.Audience = sessionAudience
+
+	w := check(newTestServer(t), claims)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "mary", w.Header().Get("X-Auth-User"))
+	assert.Equal(t, "admin,dev", w.Header().Get("X-Auth-Groups"))
+	assert.Equal(t, expires.UTC().Format(time.RFC3339), w.Header().Get("X-Auth-Expires"))
+
+	// renamed & disabled headers
+	w = check(newTestServer(t, WithIdentityHeaders("Remote-User", "", "")), claims)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "mary", w.Header().Get("Remote-User"))
+	assert.Empty(t, w.Header().Get("X-Auth-User"))
+	assert.Empty(t, w.Header().Get("X-Auth-Groups"))
+	assert.Empty(t, w.Header().Get("X-Auth-Expires"))
+}
+
+func TestAuthCheckPolicy(t *testing.T) {
+	policy, err := NewPolicy([]*PolicyRule{
+		{Path: "/admin/", Users: []string{"mary"}},
+		{Path: "/", Users: []string{PolicyAnyUser}},
+	})
+	assert.Nil(t, err)
+	s := newTestServer(t, WithPolicy(policy))
+
+	check := func(user, uri string) int {
+		token, err := newSignedJWT(s.jwtKeys.Active(), user, time.Hour)
+		assert.Nil(t, err)
+		req := httptest.NewRequest(http.MethodGet, s.authCheckURL, nil)
+		req.AddCookie(&http.Cookie{Name: s.cookieName, Value: token})
+		if uri != "" {
+			req.Header.Set("X-Original-URI", uri)
+		}
+		w := httptest.NewRecorder()
+		s.newHTTPHandler().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, check("mary", "/admin/x"))
+	assert.Equal(t, http.StatusForbidden, check("james", "/admin/x"))
+	assert.Equal(t, http.StatusForbidden, check("james", "/public/../admin/x"))
+	assert.Equal(t, http.StatusOK, check("james", "/public/x"))
+	assert.Equal(t, http.StatusOK, check("james", "")) // the check URL itself
+}
+
+func TestAuthCheckPolicyIgnoresClientHeaders(t *testing.T) {
+	policy, err := NewPolicy([]*PolicyRule{
+		{Path: "/", Hosts: []string{"admin.example.com"}, Users: []string{"mary"}},
+		{Path: "/", Users: []string{PolicyAnyUser}},
+	})
+	assert.Nil(t, err)
+	s := newTestServer(t, WithPolicy(policy))
+
+	check := func(headers map[string]string) int {
+		token, err := newSignedJWT(s.jwtKeys.Active(), "james", time.Hour)
+		assert.Nil(t, err)
+		req := httptest.NewRequest(http.MethodGet, s.authCheckURL, nil)
+		req.AddCookie(&http.Cookie{Name: s.cookieName, Value: token})
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		s.newHTTPHandler().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// nginx sets X-Original-*, X-Forwarded-* is whatever the client sent
+	original := map[string]string{"X-Original-URI": "/x", "X-Original-Host": "admin.example.com"}
+	assert.Equal(t, http.StatusForbidden, check(original))
+	original["X-Forwarded-Host"] = "public.example.com"
+	assert.Equal(t, http.StatusForbidden, check(original))
+	original["X-Original-Host"] = "public.example.com"
+	assert.Equal(t, http.StatusOK, check(original))
+}
+
+func TestLoginDisabledUser(t *testing.T) {
+	store, err := NewWritableFile(copyTestConfig(t))
+	assert.Nil(t, err)
+	s := newTestServer(t, WithStorage(store))
+
+	u, err := store.User("mary")
+	assert.Nil(t, err)
+	code, err := totp.GenerateCode(u.Secret, time.Now())
+	assert.Nil(t, err)
+
+	u.Disabled = true
+	assert.Nil(t, store.UpdateUser(u))
+	w := loginWithCSRF(t, s, "mary", code)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	u.Disabled = false
+	assert.Nil(t, store.UpdateUser(u))
+	w = loginWithCSRF(t, s, "mary", code)
+	assert.Equal(t, http.StatusFound, w.Code)
+}
+
+func TestLoginReturnTo(t *testing.T) {
+	s := newTestServer(t, WithRedirectAllowList("app.example.com"))
+	h := s.newHTTPHandler()
+
+	// the login page carries where we were going in the CSRF token
+	req := httptest.NewRequest(http.MethodGet, s.authLoginURL+"?rd="+url.QueryEscape("https://app.example.com/x"), nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	csrf := regexp.MustCompile(`name="csrf" value="([^"]+)"`).FindStringSubmatch(w.Body.String())
+	if !assert.Len(t, csrf, 2) {
+		return
+	}
+	claims, err := validateJWT(s.csrfKey, csrf[1])
+	assert.Nil(t, err)
+	assert.Equal(t, "https://app.example.com/x", claims.ReturnTo)
+
+	// and we're sent back there after logging in
+	u, err := s.store.User("mary")
+	assert.Nil(t, err)
+	code, err := totp.GenerateCode(u.Secret, time.Now())
+	assert.Nil(t, err)
+	form := url.Values{"user": {"mary"}, "token": {code}, "csrf": {csrf[1]}}
+	req = httptest.NewRequest(http.MethodPost, s.authLoginURL, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "https://app.example.com/x", w.Header().Get("Location"))
+
+	// URLs not on the allow list are ignored
+	req = httptest.NewRequest(http.MethodGet, s.authLoginURL+"?rd="+url.QueryEscape("https://evil.com/"), nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	csrf = regexp.MustCompile(`name="csrf" value="([^"]+)"`).FindStringSubmatch(w.Body.String())
+	if !assert.Len(t, csrf, 2) {
+		return
+	}
+	claims, err = validateJWT(s.csrfKey, csrf[1])
+	assert.Nil(t, err)
+	assert.Equal(t, "", claims.ReturnTo)
+}
+
+func TestAuthForward(t *testing.T) {
+	policy, err := NewPolicy([]*PolicyRule{
+		{Path: "/admin/", Methods: []string{"GET"}, Users: []string{"mary"}},
+		{Path: "/x", Users: []string{PolicyAnyUser}},
+	})
+	assert.Nil(t, err)
+	s := newTestServer(t, WithPolicy(policy), WithLoginRedirectURL("https://auth.example.com/auth/login"))
+	h := s.newHTTPHandler()
+
+	forward := func(user, method, uri string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, s.authForwardURL, nil)
+		req.Header.Set("X-Forwarded-Method", method)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", "app.example.com")
+		req.Header.Set("X-Forwarded-Uri", uri)
+		if user != "" {
+			token, err := newSignedJWT(s.jwtKeys.Active(), user, time.Hour)
+			assert.Nil(t, err)
+			req.AddCookie(&http.Cookie{Name: s.cookieName, Value: token})
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// not logged in, redirected to login & back again
+	w := forward("", "GET", "/x?y=1")
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "https://auth.example.com/auth/login?rd="+url.QueryEscape("https://app.example.com/x?y=1"), w.Header().Get("Location"))
+
+	// logged in
+	w = forward("james", "GET", "/x")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "james", w.Header().Get("X-Auth-User"))
+
+	// policy uses the forwarded method & URI
+	assert.Equal(t, http.StatusOK, forward("mary", "GET", "/admin/").Code)
+	assert.Equal(t, http.StatusForbidden, forward("mary", "POST", "/admin/").Code)
+	assert.Equal(t, http.StatusForbidden, forward("james", "GET", "/admin/").Code)
+}
+
+func TestCookieDomain(t *testing.T) {
+	s := newTestServer(t, WithCookieDomain("example.com"))
+
+	u, err := s.store.User("mary")
+	assert.Nil(t, err)
+	code, err := totp.GenerateCode(u.Secret, time.Now())
+	assert.Nil(t, err)
+	w := loginWithCSRF(t, s, "mary", code)
+	assert.Equal(t, http.StatusFound, w.Code)
+	cookies := w.Result().Cookies()
+	if assert.Len(t, cookies, 1) {
+		assert.Equal(t, "example.com", cookies[0].Domain)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, s.authLogoutURL, nil)
+	w = httptest.NewRecorder()
+	s.newHTTPHandler().ServeHTTP(w, req)
+	cookies = w.Result().Cookies()
+	if assert.Len(t, cookies, 1) {
+		assert.Equal(t, "example.com", cookies[0].Domain)
+	}
+}
+
+func TestLoginPageErrors(t *testing.T) {
+	s := newTestServer(t, WithLockoutThreshold(1))
+
+	// failed logins say so, keeping the username
+	w := loginWithCSRF(t, s, "mary", "000000")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "invalid_code", w.Header().Get(loginFailureHeader))
+	assert.Contains(t, w.Body.String(), failureInvalidCode.message())
+	assert.Contains(t, w.Body.String(), `value="mary"`)
+
+	// unknown users look the same
+	other := loginWithCSRF(t, newTestServer(t), "nobody", "000000")
+	assert.Equal(t, http.StatusUnauthorized, other.Code)
+	assert.Equal(t, "invalid_code", other.Header().Get(loginFailureHeader))
+
+	// as do lockouts, with how long to wait
+	w = loginWithCSRF(t, s, "mary", "000000")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "locked_out", w.Header().Get(loginFailureHeader))
+	assert.Contains(t, w.Body.String(), failureLockedOut.message())
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+
+	// expired (or forged) forms, from another client so we're not rate limited
+	w = postLogin(s.newHTTPHandler(), "198.51.100.1:1234", "mary", "000000")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "form_expired", w.Header().Get(loginFailureHeader))
+	assert.Contains(t, w.Body.String(), failureFormExpired.message())
+}
+
+func TestLoginLockoutBehindProxy(t *testing.T) {
+	// every client has the proxy's address
+	login := func(s *server, user, code string) int {
+		csrf, err := newJWT(s.csrfKey, "test-session", time.Minute)
+		assert.Nil(t, err)
+		form := url.Values{"user": {user}, "token": {code}, "csrf": {csrf}}
+		req := httptest.NewRequest(http.MethodPost, s.authLoginURL, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Real-IP", "198.51.100.1")
+		req.RemoteAddr = "127.0.0.1:4321"
+		w := httptest.NewRecorder()
+		s.newHTTPHandler().ServeHTTP(w, req)
+		return w.Code
+	}
+	attempts := []WebOption{WithLockoutThreshold(2), WithLoginBurst(10)}
+
+	// without a client IP header only the user is locked out, not everyone behind the proxy
+	s := newTestServer(t, attempts...)
+	assert.Equal(t, http.StatusUnauthorized, login(s, "mary", "000000"))
+	assert.Equal(t, http.StatusUnauthorized, login(s, "mary", "000000"))
+	assert.Equal(t, http.StatusTooManyRequests, login(s, "mary", "000000"))
+	assert.Equal(t, http.StatusUnauthorized, login(s, "james", "000000"))
+
+	// with one, the client is locked out too
+	s = newTestServer(t, append(attempts, WithClientIPHeader("X-Real-IP"))...)
+	assert.Equal(t, http.StatusUnauthorized, login(s, "mary", "000000"))
+	assert.Equal(t, http.StatusUnauthorized, login(s, "test", "000000"))
+	assert.Equal(t, http.StatusTooManyRequests, login(s, "james", "000000"))
+}
+
+func TestLoginPageRateLimited(t *testing.T) {
+	s := newTestServer(t, WithLoginBurst(1))
+	h := s.newHTTPHandler()
+
+	postLogin(h, "192.0.2.1:1234", "mary", "000000")
+	w := postLogin(h, "192.0.2.1:1234", "mary", "000000")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "rate_limited", w.Header().Get(loginFailureHeader))
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), failureRateLimited.message())
+}